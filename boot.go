@@ -0,0 +1,126 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"time"
+)
+
+const (
+	BOOT_TIMEOUT = 5 * time.Minute
+	// How long to keep waiting for adb once the device showed up on USB,
+	// as USB debugging is normally off after a factory reset
+	BOOT_ADB_GRACE = 30 * time.Second
+
+	BOOT_OK           = "booted successfully"
+	BOOT_NOT_OBSERVED = "boot not observed"
+)
+
+var (
+	waitBootFlag    = flag.Bool("wait-boot", false, "After the final reboot, wait for each device to boot and record the outcome in the report")
+	bootTimeoutFlag = flag.Duration("boot-timeout", BOOT_TIMEOUT, "How long to wait for each device to boot with -wait-boot")
+)
+
+// waitForBoot watches a device after its final reboot. The strongest evidence
+// is adb reporting sys.boot_completed, which also allows checking the build
+// fingerprint and the Setup Wizard. Otherwise a device that left fastboot mode
+// and reappeared on USB (only detectable on Linux) is assumed to have booted.
+func waitForBoot(ctx context.Context, serialNumber string, metadata *factoryMetadata, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for fastbootDeviceConnected(serialNumber) {
+		if time.Now().After(deadline) || sleep(ctx, CONFIRM_POLL_INTERVAL) != nil {
+			return BOOT_NOT_OBSERVED
+		}
+	}
+	seenOnUSB := false
+	for time.Now().Before(deadline) {
+		switch adbDeviceState(serialNumber) {
+		case "device":
+			if getProp("sys.boot_completed", serialNumber) == "1" {
+				if err := verifyFingerprint(serialNumber, metadata); err != nil {
+					return BOOT_OK + ", but " + err.Error()
+				}
+				if setupWizardRunning(serialNumber) {
+					return BOOT_OK + ", Setup Wizard running"
+				}
+				return BOOT_OK
+			}
+		case "unauthorized":
+			// Only Android asks to authorize USB debugging
+			return BOOT_OK + " (adb not authorized)"
+		}
+		if !seenOnUSB && usbDevicePresent(serialNumber) {
+			seenOnUSB = true
+			if grace := time.Now().Add(BOOT_ADB_GRACE); grace.Before(deadline) {
+				deadline = grace
+			}
+		}
+		if sleep(ctx, CONFIRM_POLL_INTERVAL) != nil {
+			break
+		}
+	}
+	if seenOnUSB {
+		return BOOT_OK + " (seen on USB, adb not available)"
+	}
+	return BOOT_NOT_OBSERVED
+}
+
+// adbDeviceState returns the state adb devices lists for a device, such as
+// device, unauthorized or recovery, or "" if it is not listed.
+func adbDeviceState(serialNumber string) string {
+	platformToolCommand := *adb
+	platformToolCommand.Args = append(platformToolCommand.Args, "devices")
+	out, err := commandOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == serialNumber {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func setupWizardRunning(serialNumber string) bool {
+	platformToolCommand := *adb
+	platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "shell", "dumpsys", "activity", "activities")
+	out, err := commandOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "mResumedActivity") && strings.Contains(strings.ToLower(line), "setupwizard") {
+			return true
+		}
+	}
+	return false
+}
+
+// usbDevicePresent looks for a USB device with the given serial number in
+// sysfs. It always reports false where there is no sysfs.
+func usbDevicePresent(serialNumber string) bool {
+	devices, _ := findUSBDevices(SYSFS_USB_DEVICES, udevVendorIDs())
+	for _, d := range devices {
+		if d.SerialNumber == serialNumber {
+			return true
+		}
+	}
+	return false
+}
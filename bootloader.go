@@ -0,0 +1,224 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var errNotAnswered = errors.New("request not answered")
+
+const (
+	CONFIRM_POLL_INTERVAL = 2 * time.Second
+	COUNTDOWN_INTERVAL    = 30 * time.Second
+)
+
+var confirmTimeoutFlag = flag.Duration("confirm-timeout", CONFIRM_TIMEOUT, "How long to wait for each bootloader unlock or lock to be confirmed on the device")
+
+// setLockState asks for the bootloader, or its critical partitions, to be
+// unlocked or locked and waits for the user to confirm it on the device. The
+// request is sent once. The device may disappear meanwhile, e.g. when it
+// reboots or has to be put back into fastboot mode by hand, in which case the
+// request is sent again once it is back.
+func setLockState(ctx context.Context, serialNumber string, profile *deviceProfile, unlock, critical bool) error {
+	device := profile.Codename
+	want, verb := "no", "lock"
+	if unlock {
+		want, verb = "yes", "unlock"
+	}
+	command := profile.Unlock
+	if critical {
+		// There is no oem variant of the critical partitions commands
+		command = UNLOCK_FLASHING
+		verb += "_critical"
+	}
+	// Stops a request still waiting for confirmation when we give up
+	requestCtx, cancel := context.WithTimeout(ctx, *confirmTimeoutFlag)
+	defer cancel()
+	deadline := time.Now().Add(*confirmTimeoutFlag)
+	nextCountdown := time.Now().Add(COUNTDOWN_INTERVAL)
+	connected := true
+	sent := false
+	// Whether the device answered the request without refusing it
+	answered := false
+	var pending chan error
+	var failure error
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if pending == nil {
+			if !fastbootDeviceConnected(serialNumber) {
+				if connected {
+					deviceln(serialNumber, device+" "+serialNumber+" disconnected, waiting for it to come back in fastboot mode...")
+					connected = false
+					sent = false
+				}
+			} else {
+				if !connected {
+					deviceln(serialNumber, device+" "+serialNumber+" is back in fastboot mode")
+					connected = true
+				}
+				state := getLockState(serialNumber, critical)
+				if state == want {
+					return nil
+				}
+				if state == "" && critical && answered {
+					deviceWarnln(serialNumber, "Cannot read the critical partitions lock state of "+device+" "+serialNumber+", assuming the "+verb+" succeeded")
+					return nil
+				}
+				if failure != nil {
+					return failure
+				}
+				if !sent {
+					sent = true
+					pending = make(chan error, 1)
+					go func(pending chan<- error) {
+						platformToolCommand := *fastboot
+						platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, command, verb)
+						out, err := commandCombinedOutput(requestCtx, *confirmTimeoutFlag, &platformToolCommand)
+						switch {
+						case err == nil:
+						case strings.Contains(string(out), "FAILED (remote"):
+							err = errors.New(strings.TrimSpace(string(out)))
+						default:
+							// e.g. the device rebooted before answering
+							err = errNotAnswered
+						}
+						pending <- err
+					}(pending)
+				}
+			}
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("bootloader %s was not confirmed within %v", verb, *confirmTimeoutFlag)
+		}
+		if now := time.Now(); !now.Before(nextCountdown) {
+			deviceWarnln(serialNumber, fmt.Sprintf("Waiting for the bootloader %s to be confirmed on %s %s (%v left)", verb, device, serialNumber, remaining.Round(time.Second)))
+			nextCountdown = now.Add(COUNTDOWN_INTERVAL)
+		}
+		select {
+		case err := <-pending:
+			pending = nil
+			switch err {
+			case nil:
+				answered = true
+			case errNotAnswered:
+			default:
+				// The device refused, which is final unless it already changed state
+				failure = err
+			}
+		case <-time.After(CONFIRM_POLL_INTERVAL):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// getLockState returns "yes" if the bootloader, or its critical partitions,
+// are unlocked, "no" if they are locked and "" if that cannot be determined.
+func getLockState(serialNumber string, critical bool) string {
+	if !critical {
+		return getVar("unlocked", serialNumber)
+	}
+	// Only reported by oem device-info, e.g. "(bootloader) Device critical unlocked: true"
+	platformToolCommand := *fastboot
+	platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "oem", "device-info")
+	out, err := commandCombinedOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, "critical unlocked:"); i >= 0 {
+			switch strings.TrimSpace(line[i+len("critical unlocked:"):]) {
+			case "true":
+				return "yes"
+			case "false":
+				return "no"
+			}
+		}
+	}
+	return ""
+}
+
+// verifyLockState checks that the bootloader, and the critical partitions if
+// the device has them, are all unlocked or all locked. Bootloaders without oem
+// device-info don't report the state of critical partitions, which is then
+// only warned about.
+func verifyLockState(serialNumber string, profile *deviceProfile, unlocked bool) error {
+	want := "no"
+	if unlocked {
+		want = "yes"
+	}
+	if state := getLockState(serialNumber, false); state != want {
+		return fmt.Errorf("bootloader unlocked state is %q, expected %q", state, want)
+	}
+	if profile.UnlockCritical {
+		state := getLockState(serialNumber, true)
+		if state == "" {
+			deviceWarnln(serialNumber, "Cannot verify the critical partitions lock state of "+profile.Codename+" "+serialNumber)
+		} else if state != want {
+			return fmt.Errorf("critical partitions unlocked state is %q, expected %q", state, want)
+		}
+	}
+	return nil
+}
+
+// waitForFastboot waits for a device to be (back) in fastboot mode
+func waitForFastboot(ctx context.Context, serialNumber string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !fastbootDeviceConnected(serialNumber) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not show up in fastboot mode within %v", serialNumber, timeout)
+		}
+		if err := sleep(ctx, CONFIRM_POLL_INTERVAL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sleep waits for d, returning early with an error if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func fastbootDeviceConnected(serialNumber string) bool {
+	platformToolCommand := *fastboot
+	platformToolCommand.Args = append(platformToolCommand.Args, "devices")
+	out, err := commandOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == serialNumber {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const PLATFORM_TOOLS_CATALOGUE_FILE = "platform-tools.json"
+
+// Built-in catalogue, used unless a platform-tools.json is found next to the
+// flasher or passed with -platform-tools-catalogue. An empty arch matches any,
+// e.g. for the universal macOS builds; Linux builds only run on x86_64.
+const PLATFORM_TOOLS_CATALOGUE = `{
+  "releases": [
+    {"version": "29.0.6", "os": "darwin", "arch": "", "url": "https://dl.google.com/android/repository/platform-tools_r29.0.6-darwin.zip", "sha256": "7555e8e24958cae4cfd197135950359b9fe8373d4862a03677f089d215119a3a"},
+    {"version": "29.0.6", "os": "linux", "arch": "amd64", "url": "https://dl.google.com/android/repository/platform-tools_r29.0.6-linux.zip", "sha256": "cc9e9d0224d1a917bad71fe12d209dfffe9ce43395e048ab2f07dcfc21101d44"},
+    {"version": "29.0.6", "os": "windows", "arch": "amd64", "url": "https://dl.google.com/android/repository/platform-tools_r29.0.6-windows.zip", "sha256": "247210e3c12453545f8e1f76e55de3559c03f2d785487b2e4ac00fe9698a039c"},
+    {"version": "30.0.4", "os": "darwin", "arch": "", "url": "https://dl.google.com/android/repository/fbad467867e935dce68a0296b00e6d1e76f15b15.platform-tools_r30.0.4-darwin.zip", "sha256": "e0db2bdc784c41847f854d6608e91597ebc3cef66686f647125f5a046068a890"},
+    {"version": "30.0.4", "os": "linux", "arch": "amd64", "url": "https://dl.google.com/android/repository/platform-tools_r30.0.4-linux.zip", "sha256": "5be24ed897c7e061ba800bfa7b9ebb4b0f8958cc062f4b2202701e02f2725891"},
+    {"version": "30.0.4", "os": "windows", "arch": "amd64", "url": "https://dl.google.com/android/repository/platform-tools_r30.0.4-windows.zip", "sha256": "413182fff6c5957911e231b9e97e6be4fc6a539035e3dfb580b5c54bd5950fee"}
+  ]
+}`
+
+var catalogueFlag = flag.String("platform-tools-catalogue", "", "JSON file listing platform-tools releases (default: built-in, or "+PLATFORM_TOOLS_CATALOGUE_FILE+" next to the flasher)")
+
+type platformToolsRelease struct {
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+}
+
+// platformToolsConstraint bounds the platform-tools versions a device can be
+// flashed with, see deviceProfile. Either end may be left empty.
+type platformToolsConstraint struct {
+	Min string `json:"min,omitempty"`
+	Max string `json:"max,omitempty"`
+}
+
+type platformToolsCatalogue struct {
+	Releases []platformToolsRelease `json:"releases"`
+}
+
+func loadPlatformToolsCatalogue() (*platformToolsCatalogue, error) {
+	data := []byte(PLATFORM_TOOLS_CATALOGUE)
+	source := "built-in"
+	file := *catalogueFlag
+	if file == "" {
+		if _, err := os.Stat(filepath.Join(cwd, PLATFORM_TOOLS_CATALOGUE_FILE)); err == nil {
+			file = filepath.Join(cwd, PLATFORM_TOOLS_CATALOGUE_FILE)
+		}
+	}
+	if file != "" {
+		fmt.Println("Using platform-tools catalogue " + file)
+		source = file
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	catalogue := &platformToolsCatalogue{}
+	if err := json.Unmarshal(data, catalogue); err != nil {
+		return nil, fmt.Errorf("invalid %s platform-tools catalogue: %v", source, err)
+	}
+	return catalogue, nil
+}
+
+// selectRelease picks the newest release for the given platform that is
+// compatible with every device to be flashed.
+func (c *platformToolsCatalogue) selectRelease(goos, goarch string, devices []*deviceProfile) (platformToolsRelease, error) {
+	var candidates []platformToolsRelease
+	for _, release := range c.Releases {
+		if release.OS == goos && (release.Arch == "" || release.Arch == goarch) {
+			candidates = append(candidates, release)
+		}
+	}
+	if len(candidates) == 0 {
+		return platformToolsRelease{}, fmt.Errorf("no platform-tools release for %s/%s in catalogue", goos, goarch)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return compareVersions(candidates[i].Version, candidates[j].Version) > 0
+	})
+	for _, release := range candidates {
+		if platformToolsAllowed(release.Version, devices) {
+			return release, nil
+		}
+	}
+	var codenames []string
+	for _, device := range devices {
+		codenames = append(codenames, device.Codename)
+	}
+	return platformToolsRelease{}, fmt.Errorf("no platform-tools release for %s/%s satisfies the constraints of %s",
+		goos, goarch, strings.Join(codenames, ", "))
+}
+
+func platformToolsAllowed(version string, devices []*deviceProfile) bool {
+	for _, device := range devices {
+		if !device.PlatformTools.allows(version) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c platformToolsConstraint) allows(version string) bool {
+	if c.Min != "" && compareVersions(version, c.Min) < 0 {
+		return false
+	}
+	if c.Max != "" && compareVersions(version, c.Max) > 0 {
+		return false
+	}
+	return true
+}
+
+// compareVersions compares dotted numeric versions such as 30.0.4, returning
+// -1, 0 or 1. Missing or non-numeric components count as zero.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
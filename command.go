@@ -0,0 +1,124 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Queries and short commands such as getvar, getprop, devices and reboot
+	COMMAND_TIMEOUT = 30 * time.Second
+	// Waiting for a device to reboot into fastboot mode
+	REBOOT_TIMEOUT = 2 * time.Minute
+	// Waiting for the user to confirm a bootloader unlock or lock on the device
+	CONFIRM_TIMEOUT = 5 * time.Minute
+	// A whole flash-all script run
+	FLASH_ALL_TIMEOUT = 30 * time.Minute
+)
+
+// Processes started by runCommand that have not exited yet
+var startedProcesses = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]struct{}
+}{cmds: map[*exec.Cmd]struct{}{}}
+
+type commandTimeoutError struct {
+	command string
+	timeout time.Duration
+}
+
+func (e *commandTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.command, e.timeout)
+}
+
+func isTimeout(err error) bool {
+	var timeoutErr *commandTimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// runCommand runs cmd until it exits, timeout elapses or ctx is done. In the
+// latter two cases cmd and everything it started are killed, and a timeout is
+// reported as a *commandTimeoutError.
+func runCommand(ctx context.Context, timeout time.Duration, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	startedProcesses.Lock()
+	startedProcesses.cmds[cmd] = struct{}{}
+	startedProcesses.Unlock()
+	defer func() {
+		startedProcesses.Lock()
+		delete(startedProcesses.cmds, cmd)
+		startedProcesses.Unlock()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		_ = killProcessTree(cmd)
+		<-done
+		return &commandTimeoutError{commandString(cmd), timeout}
+	case <-ctx.Done():
+		_ = killProcessTree(cmd)
+		<-done
+		return ctx.Err()
+	}
+}
+
+func commandOutput(ctx context.Context, timeout time.Duration, cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := runCommand(ctx, timeout, cmd)
+	return stdout.Bytes(), err
+}
+
+func commandCombinedOutput(ctx context.Context, timeout time.Duration, cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := runCommand(ctx, timeout, cmd)
+	return output.Bytes(), err
+}
+
+// killStartedProcesses kills every process tree started by runCommand
+func killStartedProcesses() {
+	startedProcesses.Lock()
+	defer startedProcesses.Unlock()
+	for cmd := range startedProcesses.cmds {
+		_ = killProcessTree(cmd)
+	}
+}
+
+func commandString(cmd *exec.Cmd) string {
+	return strings.Join(append([]string{filepath.Base(cmd.Path)}, cmd.Args[1:]...), " ")
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+)
+
+// runSubcommand runs a command given after the flags instead of flashing, e.g.
+// udev install, and returns the exit status
+func runSubcommand(args []string) int {
+	switch args[0] {
+	case "udev":
+		return udevCommand(args[1:])
+	case "doctor":
+		return doctorCommand(args[1:])
+	default:
+		errorln(errors.New("unknown command "+args[0]+", expected doctor or udev"), false)
+		return 2
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const CONFIG_FILE = "config.json"
+
+var configFlag = flag.String("config", "", "JSON configuration file (default: "+filepath.Join("<user config dir>", "device-flasher", CONFIG_FILE)+" if present)")
+
+// defaultConfigPath returns where the configuration of the current user is
+// looked for, e.g. ~/.config/device-flasher/config.json on Linux
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "device-flasher", CONFIG_FILE)
+}
+
+// loadConfig sets flags from a configuration file, so that a flashing station
+// can be set up once. Its keys are flag names, e.g.
+//
+//	{
+//	  "image-dirs": ["/srv/factory-images"],
+//	  "mirror": ["/srv/mirror", "https://mirror.example.com/platform-tools"],
+//	  "lock": "ask",
+//	  "max-flashing": 4,
+//	  "ui": "tui",
+//	  "error-log": "/var/log/device-flasher/error.log",
+//	  "device-policy": {"walleye": {"lock": "never"}}
+//	}
+//
+// Flags given on the command line take precedence.
+func loadConfig() error {
+	file := *configFlag
+	if file == "" {
+		file = defaultConfigPath()
+		if _, err := os.Stat(file); file == "" || os.IsNotExist(err) {
+			return nil
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Using configuration " + file)
+	settings := map[string]json.RawMessage{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("invalid configuration %s: %v", file, err)
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := applySetting(name, settings[name], set[name]); err != nil {
+			return fmt.Errorf("invalid configuration %s: %s: %v", file, name, err)
+		}
+	}
+	return nil
+}
+
+func applySetting(name string, raw json.RawMessage, onCommandLine bool) error {
+	switch name {
+	case "config":
+		return fmt.Errorf("cannot be set in a configuration file")
+	case "device-policy":
+		policies := map[string]policy{}
+		if err := json.Unmarshal(raw, &policies); err != nil {
+			return err
+		}
+		for device, p := range policies {
+			if _, ok := devicePolicies[device]; ok {
+				// Given on the command line
+				continue
+			}
+			if err := p.validate(); err != nil {
+				return err
+			}
+			devicePolicies[device] = p
+		}
+		return nil
+	}
+	if flag.Lookup(name) == nil {
+		return fmt.Errorf("unknown setting")
+	}
+	if onCommandLine {
+		return nil
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		// Lists are comma-separated on the command line
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return flag.Set(name, strings.Join(values, ","))
+	case map[string]interface{}, nil:
+		return fmt.Errorf("expected a string, number, boolean or list")
+	default:
+		return flag.Set(name, fmt.Sprint(v))
+	}
+}
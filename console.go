@@ -0,0 +1,316 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STATUS_TABLE_INTERVAL = time.Second
+	// Lines kept per device for the TUI log pane
+	LOG_LINES = 100
+)
+
+var statusTableFlag = flag.Bool("status-table", false, "Keep a live table of every device's progress at the bottom of the terminal")
+
+// Colours cycled through to tell devices apart
+var tagColors = []func(...interface{}) string{Blue, Green, Magenta, Cyan}
+
+var console = &deviceConsole{
+	out:       os.Stdout,
+	tags:      map[string]string{},
+	shown:     map[string]bool{},
+	logs:      map[string][]string{},
+	questions: map[string]*question{},
+}
+
+var ansiEscapes = regexp.MustCompile("\033\\[[0-9;?]*[A-Za-z]")
+
+// deviceConsole serializes the output of concurrently flashed devices. Each
+// line is prefixed with a coloured tag naming its device, instructions that
+// apply to every device are only shown once, and an optional status table is
+// kept below the output. In quiet mode, used by the TUI, nothing is printed
+// and lines are only kept in per-device logs.
+type deviceConsole struct {
+	sync.Mutex
+	out       io.Writer
+	tags      map[string]string
+	shown     map[string]bool
+	table     bool
+	tableRows int
+	prompting bool
+	quiet     bool
+	logs      map[string][]string
+	notices   []string
+	questions map[string]*question
+}
+
+// question is asked of the operator about a device while in quiet mode
+type question struct {
+	text   string
+	answer chan string
+	// Closed once answered
+	done chan struct{}
+}
+
+// setDevices assigns tags to the devices about to be flashed. Output is only
+// tagged when there is more than one.
+func (c *deviceConsole) setDevices(devices map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+	var serialNumbers []string
+	for serialNumber := range devices {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	sort.Strings(serialNumbers)
+	for i, serialNumber := range serialNumbers {
+		if len(devices) > 1 {
+			color := tagColors[i%len(tagColors)]
+			c.tags[serialNumber] = color("[" + devices[serialNumber] + " " + serialNumber + "]")
+		} else {
+			c.tags[serialNumber] = ""
+		}
+	}
+}
+
+func (c *deviceConsole) println(serialNumber string, line string) {
+	c.Lock()
+	defer c.Unlock()
+	logs := append(c.logs[serialNumber], ansiEscapes.ReplaceAllString(line, ""))
+	if len(logs) > LOG_LINES {
+		logs = logs[len(logs)-LOG_LINES:]
+	}
+	c.logs[serialNumber] = logs
+	if c.quiet {
+		return
+	}
+	c.clearTable()
+	if tag := c.tags[serialNumber]; tag != "" {
+		line = tag + " " + line
+	}
+	fmt.Fprintln(c.out, line)
+	c.drawTable()
+}
+
+// once prints lines the first time it is called with a given key
+func (c *deviceConsole) once(key string, lines ...string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.shown[key] {
+		return
+	}
+	c.shown[key] = true
+	if c.quiet {
+		c.notices = append(c.notices, lines...)
+		return
+	}
+	c.clearTable()
+	for _, line := range lines {
+		fmt.Fprintln(c.out, Warn(line))
+	}
+	c.drawTable()
+}
+
+// prompt asks the operator a question about a device, keeping the status table
+// out of the way. In quiet mode the question waits to be answered from the TUI.
+// Either way, answer can give up on it with an empty answer, e.g. on abort.
+func (c *deviceConsole) prompt(serialNumber, text string) string {
+	c.Lock()
+	q := &question{text: text, answer: make(chan string, 1), done: make(chan struct{})}
+	c.questions[serialNumber] = q
+	if !c.quiet {
+		c.clearTable()
+		c.prompting = true
+		fmt.Fprint(c.out, Warn(text))
+		go func() {
+			// Once answered elsewhere, leave the input to the next reader
+			answer, err := stdin.readLine(q.done)
+			if err != errInputCanceled {
+				c.answer(serialNumber, strings.TrimSpace(answer))
+			}
+		}()
+	}
+	c.Unlock()
+	answer := <-q.answer
+	c.Lock()
+	if c.prompting {
+		c.prompting = false
+		c.drawTable()
+	}
+	c.Unlock()
+	return answer
+}
+
+// answer answers the pending question about a device, if any
+func (c *deviceConsole) answer(serialNumber, answer string) bool {
+	c.Lock()
+	defer c.Unlock()
+	q, ok := c.questions[serialNumber]
+	if !ok {
+		return false
+	}
+	delete(c.questions, serialNumber)
+	q.answer <- answer
+	close(q.done)
+	return true
+}
+
+// pending returns the question waiting to be answered about a device
+func (c *deviceConsole) pending(serialNumber string) string {
+	c.Lock()
+	defer c.Unlock()
+	if q, ok := c.questions[serialNumber]; ok {
+		return q.text
+	}
+	return ""
+}
+
+func (c *deviceConsole) setQuiet(quiet bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.quiet = quiet
+}
+
+// log returns the last lines printed for a device
+func (c *deviceConsole) log(serialNumber string) []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.logs[serialNumber]...)
+}
+
+func (c *deviceConsole) getNotices() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.notices...)
+}
+
+// writer returns a writer that prints whole lines tagged for a device, for
+// the output of commands such as flash-all. Flush it once the command exits.
+func (c *deviceConsole) writer(serialNumber string) *lineWriter {
+	return &lineWriter{serialNumber: serialNumber}
+}
+
+// startTable keeps a status table of every device below the output, if
+// enabled and stdout is a terminal, until stop is called
+func (c *deviceConsole) startTable() (stop func()) {
+	if !*statusTableFlag || !isTerminal(os.Stdout) {
+		return func() {}
+	}
+	c.Lock()
+	c.table = true
+	c.drawTable()
+	c.Unlock()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(STATUS_TABLE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Lock()
+				c.clearTable()
+				c.drawTable()
+				c.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		c.Lock()
+		c.clearTable()
+		c.table = false
+		c.Unlock()
+	}
+}
+
+func (c *deviceConsole) clearTable() {
+	if c.tableRows > 0 {
+		// Move up to the first row and clear everything below
+		fmt.Fprintf(c.out, "\033[%dA\r\033[J", c.tableRows)
+		c.tableRows = 0
+	}
+}
+
+func (c *deviceConsole) drawTable() {
+	if !c.table || c.prompting {
+		return
+	}
+	results := report.snapshot()
+	for _, result := range results {
+		row := fmt.Sprintf("%-16s %-20s %-10s %-22s %8v", result.Device, result.SerialNumber, result.Status, result.Step, result.elapsed().Round(time.Second))
+		if result.Status == STATUS_FAILED || result.Status == STATUS_INTERRUPTED {
+			row = Error(row)
+		}
+		fmt.Fprintln(c.out, row)
+	}
+	c.tableRows = len(results)
+}
+
+type lineWriter struct {
+	serialNumber string
+	buf          bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	// Progress output uses carriage returns, treat those as line ends too
+	w.buf.Write(bytes.Replace(p, []byte("\r"), []byte("\n"), -1))
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		if line = strings.TrimRight(line, "\n"); line != "" {
+			console.println(w.serialNumber, line)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush prints what is left of a last line without a line ending
+func (w *lineWriter) Flush() {
+	if line := w.buf.String(); line != "" {
+		console.println(w.serialNumber, line)
+	}
+	w.buf.Reset()
+}
+
+func deviceln(serialNumber string, line string) {
+	console.println(serialNumber, line)
+}
+
+func deviceWarnln(serialNumber string, warning string) {
+	console.println(serialNumber, Warn(warning))
+}
+
+func deviceErrorln(serialNumber string, err interface{}) {
+	logError(serialNumber + ": " + fmt.Sprint(err))
+	console.println(serialNumber, Error(err))
+}
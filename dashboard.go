@@ -0,0 +1,350 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var httpFlag = flag.String("http", "", "Serve a dashboard and HTTP API on this address, e.g. :8080 for 127.0.0.1:8080, or 0.0.0.0:8080 for the whole network")
+
+// deviceBackend is what the dashboard shows and controls, a station flashing
+// real devices or a fake one
+type deviceBackend interface {
+	devices() []deviceResult
+	log(serialNumber string) []string
+	start(serialNumber string) error
+	abort(serialNumber string) error
+	// discover looks for newly connected devices
+	discover() error
+}
+
+// stationBackend serves a station and the run report
+type stationBackend struct {
+	st *station
+}
+
+func (b stationBackend) devices() []deviceResult {
+	return report.snapshot()
+}
+
+func (b stationBackend) log(serialNumber string) []string {
+	return console.log(serialNumber)
+}
+
+func (b stationBackend) start(serialNumber string) error {
+	return b.st.start(serialNumber)
+}
+
+func (b stationBackend) abort(serialNumber string) error {
+	return b.st.abort(serialNumber)
+}
+
+func (b stationBackend) discover() error {
+	// Probing a device being flashed could get in the way of its commands
+	devices, err := filterDevices(findDevices(b.st.known))
+	if err != nil {
+		return err
+	}
+	for serialNumber, device := range devices {
+		b.st.add(serialNumber, device)
+	}
+	return nil
+}
+
+// newDashboard serves:
+//
+//	GET  /                                the dashboard
+//	GET  /api/devices                     every device and its state
+//	GET  /api/devices/SERIAL              one device
+//	GET  /api/devices/SERIAL/log          the last lines of output of a device
+//	POST /api/devices/SERIAL/start|abort  start (or retry) or abort flashing a device
+//	POST /api/discover                    look for newly connected devices
+//
+// The API requires token, as an Authorization: Bearer header, and rejects
+// requests made by pages from other origins.
+func newDashboard(backend deviceBackend, token string) http.Handler {
+	mux := http.NewServeMux()
+	api := http.NewServeMux()
+	mux.Handle("/api/", authorize(token, api))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(DASHBOARD_HTML))
+	})
+	api.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, backend.devices())
+	})
+	api.HandleFunc("/api/devices/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+		serialNumber := parts[0]
+		var result *deviceResult
+		for _, d := range backend.devices() {
+			if d.SerialNumber == serialNumber {
+				d := d
+				result = &d
+			}
+		}
+		if result == nil {
+			writeError(w, errUnknownDevice)
+			return
+		}
+		switch {
+		case len(parts) == 1:
+			if allowMethod(w, r, http.MethodGet) {
+				writeJSON(w, http.StatusOK, result)
+			}
+		case len(parts) == 2 && parts[1] == "log":
+			if allowMethod(w, r, http.MethodGet) {
+				writeJSON(w, http.StatusOK, backend.log(serialNumber))
+			}
+		case len(parts) == 2 && (parts[1] == "start" || parts[1] == "abort"):
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			action := backend.start
+			if parts[1] == "abort" {
+				action = backend.abort
+			}
+			if err := action(serialNumber); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	api.HandleFunc("/api/discover", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err := backend.discover(); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, backend.devices())
+	})
+	return mux
+}
+
+// authorize only lets requests with the token through, and none made by a
+// page from another origin, e.g. a cross-site POST
+func authorize(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "cross-origin request"})
+				return
+			}
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dashboardAddress listens on 127.0.0.1 unless a host is given, so that the
+// dashboard is only reachable from other machines on purpose
+func dashboardAddress(addr string) string {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return addr
+}
+
+// newDashboardToken returns a random token for the API of one run
+func newDashboardToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// serveDashboard starts serving the dashboard in the background and returns
+// its URL, including the token
+func serveDashboard(addr string, backend deviceBackend) (*http.Server, string, error) {
+	token, err := newDashboardToken()
+	if err != nil {
+		return nil, "", err
+	}
+	addr = dashboardAddress(addr)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	server := &http.Server{Handler: newDashboard(backend, token)}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			errorln(err, false)
+		}
+	}()
+	return server, "http://" + addr + "/#token=" + token, nil
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errUnknownDevice):
+		status = http.StatusNotFound
+	case errors.Is(err, errDeviceBusy), errors.Is(err, errDeviceIdle):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+const DASHBOARD_HTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Android Factory Image Flasher</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; }
+tr.failed, tr.aborted { color: #b00; }
+tr.flashed { color: #070; }
+tr.selected { background: #eef; }
+pre { background: #f4f4f4; padding: 1em; max-height: 30em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>Android Factory Image Flasher</h1>
+<p><button id="discover">Discover devices</button> <span id="message"></span></p>
+<table>
+<thead><tr><th>Device</th><th>Serial</th><th>Status</th><th>Step</th><th>Started</th><th>Last error</th><th></th></tr></thead>
+<tbody id="devices"></tbody>
+</table>
+<h2 id="log-title"></h2>
+<pre id="log"></pre>
+<script>
+var selected = "";
+// Given in the URL printed by the flasher, e.g. http://127.0.0.1:8080/#token=...
+var token = new URLSearchParams(location.hash.slice(1)).get("token") || "";
+
+function request(method, url) {
+  return fetch(url, {method: method, headers: {"Authorization": "Bearer " + token}}).then(function(response) {
+    if (!response.ok) {
+      return response.json().then(function(body) { throw new Error(body.error); });
+    }
+    return response.status == 204 ? null : response.json();
+  });
+}
+
+function showError(err) {
+  document.getElementById("message").textContent = err.message;
+}
+
+function action(serial, name) {
+  request("POST", "/api/devices/" + encodeURIComponent(serial) + "/" + name)
+    .then(refresh, function(err) { showError(new Error(serial + ": " + err.message)); });
+}
+
+function discover() {
+  request("POST", "/api/discover").then(refresh, showError);
+}
+
+function cell(row, text) {
+  var td = document.createElement("td");
+  td.textContent = text;
+  row.appendChild(td);
+}
+
+function refresh() {
+  request("GET", "/api/devices").then(function(devices) {
+    var tbody = document.getElementById("devices");
+    tbody.textContent = "";
+    devices.forEach(function(d) {
+      var row = document.createElement("tr");
+      row.className = d.status + (d.serial_number == selected ? " selected" : "");
+      row.dataset.serial = d.serial_number;
+      row.addEventListener("click", function() {
+        selected = this.dataset.serial;
+        refresh();
+      });
+      cell(row, d.device);
+      cell(row, d.serial_number);
+      cell(row, d.status);
+      cell(row, d.step);
+      cell(row, d.started.indexOf("0001-") == 0 ? "" : new Date(d.started).toLocaleTimeString());
+      cell(row, d.error || "");
+      var button = document.createElement("button");
+      button.textContent = d.status == "flashing" ? "abort" : "start";
+      button.dataset.serial = d.serial_number;
+      button.addEventListener("click", function(event) {
+        event.stopPropagation();
+        action(this.dataset.serial, this.textContent);
+      });
+      var td = document.createElement("td");
+      td.appendChild(button);
+      row.appendChild(td);
+      tbody.appendChild(row);
+    });
+  }, showError);
+  if (selected) {
+    request("GET", "/api/devices/" + encodeURIComponent(selected) + "/log").then(function(lines) {
+      document.getElementById("log-title").textContent = selected;
+      document.getElementById("log").textContent = (lines || []).join("\n");
+    });
+  }
+}
+
+document.getElementById("discover").addEventListener("click", discover);
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
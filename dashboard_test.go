@@ -0,0 +1,211 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const TEST_TOKEN = "secret"
+
+// fakeBackend flashes nothing, it only tracks which devices are flashing
+type fakeBackend struct {
+	results    []deviceResult
+	logs       map[string][]string
+	discovered bool
+}
+
+func (b *fakeBackend) devices() []deviceResult {
+	return b.results
+}
+
+func (b *fakeBackend) log(serialNumber string) []string {
+	return b.logs[serialNumber]
+}
+
+func (b *fakeBackend) setStatus(serialNumber, from, to string) error {
+	for i := range b.results {
+		if b.results[i].SerialNumber != serialNumber {
+			continue
+		}
+		if b.results[i].Status != from {
+			if from == STATUS_FLASHING {
+				return errDeviceIdle
+			}
+			return errDeviceBusy
+		}
+		b.results[i].Status = to
+		return nil
+	}
+	return errUnknownDevice
+}
+
+func (b *fakeBackend) start(serialNumber string) error {
+	return b.setStatus(serialNumber, STATUS_READY, STATUS_FLASHING)
+}
+
+func (b *fakeBackend) abort(serialNumber string) error {
+	return b.setStatus(serialNumber, STATUS_FLASHING, STATUS_ABORTED)
+}
+
+func (b *fakeBackend) discover() error {
+	b.discovered = true
+	return nil
+}
+
+func newTestDashboard(t *testing.T) (*httptest.Server, *fakeBackend) {
+	backend := &fakeBackend{
+		results: []deviceResult{
+			{SerialNumber: "A1", Device: "sunfish", Status: STATUS_READY},
+			{SerialNumber: "B2", Device: "bramble", Status: STATUS_FLASHING},
+		},
+		logs: map[string][]string{"B2": {"Sending 'boot_a'", "OKAY"}},
+	}
+	server := httptest.NewServer(newDashboard(backend, TEST_TOKEN))
+	t.Cleanup(server.Close)
+	return server, backend
+}
+
+func request(t *testing.T, server *httptest.Server, method, path string, header map[string]string, v interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+TEST_TOKEN)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestDashboardDevices(t *testing.T) {
+	server, _ := newTestDashboard(t)
+	var devices []deviceResult
+	if code := request(t, server, http.MethodGet, "/api/devices", nil, &devices); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(devices) != 2 || devices[0].SerialNumber != "A1" || devices[1].Status != STATUS_FLASHING {
+		t.Errorf("got devices %+v", devices)
+	}
+
+	var device deviceResult
+	if code := request(t, server, http.MethodGet, "/api/devices/B2", nil, &device); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if device.Device != "bramble" || device.Status != STATUS_FLASHING {
+		t.Errorf("got device %+v", device)
+	}
+
+	var lines []string
+	if code := request(t, server, http.MethodGet, "/api/devices/B2/log", nil, &lines); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if want := []string{"Sending 'boot_a'", "OKAY"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got log %q, want %q", lines, want)
+	}
+}
+
+func TestDashboardActions(t *testing.T) {
+	server, backend := newTestDashboard(t)
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodPost, "/api/devices/A1/start", http.StatusNoContent},
+		{http.MethodPost, "/api/devices/A1/start", http.StatusConflict},
+		{http.MethodPost, "/api/devices/B2/abort", http.StatusNoContent},
+		{http.MethodPost, "/api/devices/B2/abort", http.StatusConflict},
+		{http.MethodGet, "/api/devices/A1/abort", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/devices/C3/start", http.StatusNotFound},
+		{http.MethodGet, "/api/devices/C3", http.StatusNotFound},
+		{http.MethodGet, "/api/devices/A1/reboot", http.StatusNotFound},
+		{http.MethodPost, "/api/discover", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := request(t, server, test.method, test.path, nil, nil); code != test.code {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, code, test.code)
+		}
+	}
+	if backend.results[0].Status != STATUS_FLASHING || backend.results[1].Status != STATUS_ABORTED {
+		t.Errorf("got devices %+v", backend.results)
+	}
+	if !backend.discovered {
+		t.Error("discover was not called")
+	}
+}
+
+func TestDashboardAuthorization(t *testing.T) {
+	server, backend := newTestDashboard(t)
+	tests := []struct {
+		name   string
+		header map[string]string
+		code   int
+	}{
+		{"no token", map[string]string{"Authorization": ""}, http.StatusUnauthorized},
+		{"wrong token", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"foreign origin", map[string]string{"Origin": "http://example.com"}, http.StatusForbidden},
+		{"same origin", map[string]string{"Origin": server.URL}, http.StatusConflict},
+	}
+	for _, test := range tests {
+		// B2 is already flashing, so an authorized start is a conflict and
+		// nothing changes either way
+		if code := request(t, server, http.MethodPost, "/api/devices/B2/start", test.header, nil); code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.name, code, test.code)
+		}
+	}
+	if backend.results[1].Status != STATUS_FLASHING {
+		t.Errorf("got device %+v", backend.results[1])
+	}
+
+	// The page itself carries no data and is served without the token
+	resp, err := server.Client().Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for the dashboard", resp.StatusCode)
+	}
+}
+
+func TestDashboardAddress(t *testing.T) {
+	tests := map[string]string{
+		"8080":         "127.0.0.1:8080",
+		":8080":        "127.0.0.1:8080",
+		"0.0.0.0:8080": "0.0.0.0:8080",
+		"[::1]:8080":   "[::1]:8080",
+	}
+	for addr, want := range tests {
+		if got := dashboardAddress(addr); got != want {
+			t.Errorf("dashboardAddress(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
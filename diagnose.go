@@ -0,0 +1,175 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Where udev loads rules from, in order of precedence
+var UDEV_RULES_DIRS = []string{"/etc/udev/rules.d", "/run/udev/rules.d", "/usr/lib/udev/rules.d", "/lib/udev/rules.d"}
+
+// usbProblem is why a device cannot be used, and how to fix it
+type usbProblem struct {
+	// Empty when no device was found at all
+	Device  *usbDevice
+	Problem string
+	Remedy  []string
+}
+
+// usbDiagnostics finds out why Android devices are not usable over USB on
+// Linux. Its paths are those of the running system unless set otherwise.
+type usbDiagnostics struct {
+	SysfsRoot string
+	DevRoot   string
+	RulesDirs []string
+	VendorIDs []string
+	// Groups of the current user by ID, nil for the actual ones
+	Groups map[string]bool
+	// Whether a device node can be opened, nil for usbAccessible
+	Accessible func(node string) bool
+}
+
+func newUSBDiagnostics() *usbDiagnostics {
+	return &usbDiagnostics{
+		SysfsRoot: SYSFS_USB_DEVICES,
+		DevRoot:   DEV_BUS_USB,
+		RulesDirs: UDEV_RULES_DIRS,
+		VendorIDs: udevVendorIDs(),
+	}
+}
+
+// run checks every connected device of the supported vendors
+func (u *usbDiagnostics) run() []usbProblem {
+	devices, err := findUSBDevices(u.SysfsRoot, u.VendorIDs)
+	if err != nil {
+		return []usbProblem{{Problem: "cannot list USB devices: " + err.Error()}}
+	}
+	if len(devices) == 0 {
+		return []usbProblem{{
+			Problem: "no supported device is connected over USB",
+			Remedy: []string{
+				"Check the cable, and try another USB port, ideally directly on the computer rather than through a hub",
+				"Make sure the device is turned on, either booted with USB debugging enabled or in fastboot mode",
+			},
+		}}
+	}
+	var problems []usbProblem
+	for i := range devices {
+		if problem := u.check(&devices[i]); problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+	return problems
+}
+
+func (u *usbDiagnostics) check(d *usbDevice) *usbProblem {
+	node := d.node(u.DevRoot)
+	info, err := os.Stat(node)
+	if err != nil {
+		return &usbProblem{
+			Device:  d,
+			Problem: "device node " + node + " is missing",
+			Remedy:  []string{"Check that udev is running, e.g. systemctl status systemd-udevd, then reconnect the device"},
+		}
+	}
+	accessible := u.Accessible
+	if accessible == nil {
+		accessible = usbAccessible
+	}
+	if accessible(node) {
+		return nil
+	}
+	problem := &usbProblem{Device: d, Problem: "no permission to access " + node + " (" + info.Mode().String() + ")"}
+	rules := u.rulesFor(d.VendorID)
+	if len(rules) == 0 {
+		problem.Remedy = append(problem.Remedy,
+			"No udev rule grants access to vendor "+d.VendorID+". Run: sudo "+os.Args[0]+" udev install",
+			"Then reconnect the device")
+		return problem
+	}
+	if gid := fileGroupID(info); gid != "" && info.Mode()&0060 == 0060 && !u.inGroup(gid) {
+		name := gid
+		if group, err := user.LookupGroupId(gid); err == nil {
+			name = group.Name
+		}
+		username := "$USER"
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+		problem.Remedy = append(problem.Remedy,
+			"Devices are accessible to the "+name+" group, which you are not a member of. Run: sudo usermod -aG "+name+" "+username,
+			"Then log out and back in for the group membership to take effect")
+		return problem
+	}
+	problem.Remedy = append(problem.Remedy,
+		"udev rules for vendor "+d.VendorID+" are installed ("+strings.Join(rules, ", ")+") but were not applied to this device",
+		"Reconnect the device, or run: sudo udevadm control --reload-rules && sudo udevadm trigger --subsystem-match=usb",
+		"Rules tagged uaccess only apply to the user logged in at the computer, not over SSH")
+	return problem
+}
+
+// rulesFor returns the udev rules files matching a vendor ID
+func (u *usbDiagnostics) rulesFor(vendorID string) []string {
+	var files []string
+	match := strings.ToLower("ATTR{idVendor}==\"" + vendorID + "\"")
+	for _, dir := range u.RulesDirs {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.rules"))
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err == nil && strings.Contains(strings.ToLower(string(data)), match) {
+				files = append(files, path)
+			}
+		}
+	}
+	return files
+}
+
+func (u *usbDiagnostics) inGroup(gid string) bool {
+	if u.Groups != nil {
+		return u.Groups[gid]
+	}
+	current, err := user.Current()
+	if err != nil {
+		return false
+	}
+	ids, err := current.GroupIds()
+	if err != nil {
+		return false
+	}
+	return contains(ids, gid)
+}
+
+// printUSBProblems prints each problem once, through the console so as not to
+// get in the way of a TUI
+func printUSBProblems(problems []usbProblem) {
+	for _, problem := range problems {
+		line := problem.Problem
+		if d := problem.Device; d != nil {
+			line = fmt.Sprintf("%s %s (%s:%s, bus %03d device %03d): %s", d.Product, d.SerialNumber, d.VendorID, d.ProductID, d.Bus, d.Device, problem.Problem)
+		}
+		lines := []string{line}
+		for _, remedy := range problem.Remedy {
+			lines = append(lines, "  - "+remedy)
+		}
+		console.once("usb "+line, lines...)
+	}
+}
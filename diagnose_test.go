@@ -0,0 +1,163 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestDiagnostics lays out a Pixel on bus 1 device 5 the way sysfs and
+// /dev/bus/usb show it, along with a hub of another vendor and an empty udev
+// rules directory. Nothing is accessible and the user is in no group.
+func newTestDiagnostics(t *testing.T) *usbDiagnostics {
+	root, err := ioutil.TempDir("", "diagnose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	sysfs := map[string]map[string]string{
+		"1-2": {"idVendor": "18d1", "idProduct": "4ee0", "serial": "A1", "product": "Pixel 4a", "busnum": "1", "devnum": "5"},
+		// Interfaces and root hubs are skipped
+		"1-2:1.0": {"idVendor": "18d1"},
+		"usb1":    {"idVendor": "1d6b", "busnum": "1", "devnum": "1"},
+		"1-1":     {"idVendor": "05e3", "idProduct": "0610", "busnum": "1", "devnum": "2"},
+	}
+	for name, attributes := range sysfs {
+		dir := filepath.Join(root, "sys", name)
+		mkdir(t, dir)
+		for attribute, value := range attributes {
+			writeFile(t, filepath.Join(dir, attribute), value+"\n", 0644)
+		}
+	}
+	mkdir(t, filepath.Join(root, "dev", "001"))
+	writeFile(t, filepath.Join(root, "dev", "001", "005"), "", 0660)
+	mkdir(t, filepath.Join(root, "rules"))
+
+	return &usbDiagnostics{
+		SysfsRoot:  filepath.Join(root, "sys"),
+		DevRoot:    filepath.Join(root, "dev"),
+		RulesDirs:  []string{filepath.Join(root, "rules")},
+		VendorIDs:  []string{"18d1", "2a70"},
+		Groups:     map[string]bool{},
+		Accessible: func(string) bool { return false },
+	}
+}
+
+func mkdir(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, path, data string, mode os.FileMode) {
+	if err := ioutil.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	// Not subject to the umask
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// installTestRule installs the rules udev install would for the Pixel's vendor
+func installTestRule(t *testing.T, u *usbDiagnostics) string {
+	path := filepath.Join(u.RulesDirs[0], RULES_FILE)
+	writeFile(t, path, generateUdevRules([]string{"18d1"}, USB_GROUP), 0644)
+	return path
+}
+
+func deviceGroupID(t *testing.T, u *usbDiagnostics) string {
+	info, err := os.Stat(filepath.Join(u.DevRoot, "001", "005"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileGroupID(info)
+}
+
+// diagnose runs u and checks it finds a single problem with the Pixel, whose
+// remedy mentions want
+func diagnose(t *testing.T, u *usbDiagnostics, want string) {
+	t.Helper()
+	problems := u.run()
+	if len(problems) != 1 {
+		t.Fatalf("got %d problems, want 1: %+v", len(problems), problems)
+	}
+	problem := problems[0]
+	if problem.Device == nil || problem.Device.SerialNumber != "A1" || problem.Device.Bus != 1 || problem.Device.Device != 5 {
+		t.Errorf("got device %+v", problem.Device)
+	}
+	remedy := strings.Join(problem.Remedy, "\n")
+	if !strings.Contains(remedy, want) {
+		t.Errorf("remedy %q does not mention %q", remedy, want)
+	}
+}
+
+func TestDiagnoseAccessible(t *testing.T) {
+	u := newTestDiagnostics(t)
+	u.Accessible = func(string) bool { return true }
+	if problems := u.run(); len(problems) != 0 {
+		t.Errorf("got problems %+v", problems)
+	}
+}
+
+func TestDiagnoseNoDevice(t *testing.T) {
+	u := newTestDiagnostics(t)
+	u.VendorIDs = []string{"2a70"}
+	problems := u.run()
+	if len(problems) != 1 || problems[0].Device != nil || !strings.Contains(problems[0].Problem, "no supported device") {
+		t.Errorf("got problems %+v", problems)
+	}
+}
+
+func TestDiagnoseMissingNode(t *testing.T) {
+	u := newTestDiagnostics(t)
+	if err := os.Remove(filepath.Join(u.DevRoot, "001", "005")); err != nil {
+		t.Fatal(err)
+	}
+	diagnose(t, u, "systemd-udevd")
+}
+
+func TestDiagnoseNoRule(t *testing.T) {
+	u := newTestDiagnostics(t)
+	diagnose(t, u, "udev install")
+}
+
+func TestDiagnoseWrongGroup(t *testing.T) {
+	u := newTestDiagnostics(t)
+	installTestRule(t, u)
+	diagnose(t, u, "usermod -aG")
+}
+
+func TestDiagnoseNotApplied(t *testing.T) {
+	u := newTestDiagnostics(t)
+	rule := installTestRule(t, u)
+	u.Groups[deviceGroupID(t, u)] = true
+	diagnose(t, u, "are installed ("+rule+")")
+
+	// Without group access, membership does not help either
+	if err := os.Chmod(filepath.Join(u.DevRoot, "001", "005"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u.Groups = map[string]bool{}
+	diagnose(t, u, "udevadm trigger")
+}
@@ -0,0 +1,281 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Free space needed in the flasher's directory and each -image-dirs one to
+// extract a factory image
+const DOCTOR_MIN_FREE_SPACE = 10 << 30
+
+// doctor checks that the machine is ready to flash, printing each finding
+type doctor struct {
+	problems int
+}
+
+func (d *doctor) ok(check, detail string) {
+	fmt.Println(Green("[ OK ] ") + check + ": " + detail)
+}
+
+func (d *doctor) warn(check, detail string) {
+	fmt.Println(Warn("[WARN] ") + check + ": " + detail)
+}
+
+func (d *doctor) problem(check, detail string) {
+	d.problems++
+	fmt.Println(Error("[FAIL] ") + check + ": " + detail)
+}
+
+// doctorCommand checks the environment and returns 1 if there are problems
+func doctorCommand(args []string) int {
+	if len(args) != 0 {
+		errorln("Usage: doctor", false)
+		return 2
+	}
+	d := &doctor{}
+	d.ok("System", OS+"/"+runtime.GOARCH+", flasher version "+version)
+	if err := loadDeviceProfiles(); err != nil {
+		d.problem("Device profiles", err.Error())
+		deviceProfiles = map[string]*deviceProfile{}
+	}
+	devices := d.checkFactoryImages()
+	d.checkDiskSpace()
+	if d.checkPlatformTools(devices) {
+		defer killPlatformTools()
+		d.checkAdbServer()
+		d.checkDevices()
+	}
+	if OS == "linux" {
+		d.checkUdev()
+	}
+	fmt.Println()
+	if d.problems > 0 {
+		fmt.Println(Error(fmt.Sprintf("%d problem(s) found", d.problems)))
+		return 1
+	}
+	fmt.Println(Green("Ready to flash"))
+	return 0
+}
+
+// checkFactoryImages validates the factory images next to the flasher and
+// returns the profiles of their devices
+func (d *doctor) checkFactoryImages() []*deviceProfile {
+	dirs := imageDirs()
+	var devices []*deviceProfile
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			d.problem("Factory images", err.Error())
+			continue
+		}
+		for _, file := range files {
+			name := file.Name()
+			if !strings.Contains(name, "factory") || !strings.HasSuffix(name, ".zip") {
+				continue
+			}
+			codename := strings.Split(name, "-")[0]
+			profile := getProfile(codename)
+			devices = append(devices, profile)
+			if err := validateFactoryImage(filepath.Join(dir, name)); err != nil {
+				d.problem("Factory image "+name, err.Error())
+				continue
+			}
+			if _, ok := deviceProfiles[profile.Codename]; !ok {
+				d.warn("Factory image "+name, "no device profile for "+codename+", using defaults")
+				continue
+			}
+			d.ok("Factory image "+name, profile.Codename)
+		}
+	}
+	if len(devices) == 0 {
+		d.problem("Factory images", "no factory image found in "+strings.Join(dirs, ", "))
+	}
+	return devices
+}
+
+// validateFactoryImage checks that a factory image zip is readable and has
+// what flashing needs
+func validateFactoryImage(file string) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var flashAll, image bool
+	for _, f := range r.File {
+		switch base := path.Base(f.Name); {
+		case base == "flash-all.sh" || base == "flash-all.bat":
+			flashAll = true
+		case strings.HasPrefix(base, "image-") && strings.HasSuffix(base, ".zip"):
+			image = true
+		}
+	}
+	switch {
+	case !flashAll:
+		return fmt.Errorf("no flash-all script")
+	case !image:
+		return fmt.Errorf("no image zip")
+	}
+	return nil
+}
+
+// checkDiskSpace checks every directory factory images are read from
+func (d *doctor) checkDiskSpace() {
+	for _, dir := range imageDirs() {
+		free, err := freeSpace(dir)
+		switch {
+		case err != nil:
+			d.warn("Disk space", err.Error())
+		case free < DOCTOR_MIN_FREE_SPACE:
+			d.problem("Disk space", fmt.Sprintf("%s free in %s, at least %s needed", Bytes(free), dir, Bytes(DOCTOR_MIN_FREE_SPACE)))
+		default:
+			d.ok("Disk space", Bytes(free)+" free in "+dir)
+		}
+	}
+}
+
+// checkPlatformTools finds the platform tools the flasher would use, without
+// downloading or extracting anything, and reports whether they can be run
+func (d *doctor) checkPlatformTools(devices []*deviceProfile) bool {
+	catalogue, err := loadPlatformToolsCatalogue()
+	if err != nil {
+		d.problem("Platform tools", err.Error())
+		return false
+	}
+	release, err := catalogue.selectRelease(OS, runtime.GOARCH, devices)
+	if err != nil {
+		d.problem("Platform tools", err.Error())
+		return false
+	}
+	if *platformToolsFlag != "download" {
+		compatible := func(version string) bool {
+			return compareVersions(version, release.Version) >= 0 && platformToolsAllowed(version, devices)
+		}
+		adbPath, fastbootPath, version, err := findSystemPlatformTools(compatible)
+		if err == nil {
+			d.ok("Platform tools", "installed "+version+" in "+filepath.Dir(fastbootPath))
+			usePlatformTools(adbPath, fastbootPath)
+			return true
+		}
+		if *platformToolsFlag == "system" {
+			d.problem("Platform tools", err.Error())
+			return false
+		}
+	}
+	platformToolsPath := filepath.Join(cwd, "platform-tools")
+	adbPath := filepath.Join(platformToolsPath, executableName("adb"))
+	fastbootPath := filepath.Join(platformToolsPath, executableName("fastboot"))
+	if platformToolVersion(adbPath, "version") == release.Version && platformToolVersion(fastbootPath, "--version") == release.Version {
+		d.ok("Platform tools", release.Version+" in "+platformToolsPath)
+		usePlatformTools(adbPath, fastbootPath)
+		return true
+	}
+	zipFile := path.Base(release.URL)
+	if _, err := os.Stat(zipFile); err == nil {
+		if err := verifyZip(zipFile, release.SHA256); err != nil {
+			d.problem("Platform tools", zipFile+" checksum verification failed, delete it to download it again")
+		} else {
+			d.ok("Platform tools", zipFile+" checksum verified, it will be extracted")
+		}
+	} else if *offlineFlag {
+		d.problem("Platform tools", zipFile+" is missing and -offline is set")
+	} else {
+		d.warn("Platform tools", release.Version+" will be downloaded from "+release.URL)
+	}
+	return false
+}
+
+// checkAdbServer reports on the standard adb server, which the flasher leaves
+// alone by running its own
+func (d *doctor) checkAdbServer() {
+	conn, err := net.Dial("tcp", "127.0.0.1:5037")
+	if err != nil {
+		d.ok("adb server", "none running on the standard port 5037")
+	} else {
+		conn.Close()
+		d.ok("adb server", "one is running on the standard port 5037, the flasher uses its own")
+	}
+	if err := startAdbServer(); err != nil {
+		d.problem("adb server", err.Error())
+	}
+}
+
+// checkDevices lists connected devices and their state in adb and fastboot
+func (d *doctor) checkDevices() {
+	found := false
+	for _, tool := range []*exec.Cmd{adb, fastboot} {
+		platformToolCommand := *tool
+		platformToolCommand.Args = append(platformToolCommand.Args, "devices")
+		out, err := commandOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+		if err != nil {
+			d.problem("Devices", commandString(&platformToolCommand)+": "+err.Error())
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(line, "List of devices") {
+				continue
+			}
+			found = true
+			serialNumber, state := fields[0], strings.Join(fields[1:], " ")
+			name := "Device " + serialNumber
+			switch state {
+			case "device", "fastboot":
+				d.ok(name, state)
+			case "unauthorized":
+				d.problem(name, "unauthorized, allow USB debugging on the device")
+			default:
+				d.problem(name, state)
+			}
+		}
+	}
+	if !found {
+		d.warn("Devices", "none connected")
+	}
+}
+
+func (d *doctor) checkUdev() {
+	if _, err := os.Stat(RULES_PATH + RULES_FILE); err != nil {
+		d.warn("udev rules", RULES_PATH+RULES_FILE+" is not installed, run: sudo "+os.Args[0]+" udev install")
+	} else {
+		d.ok("udev rules", RULES_PATH+RULES_FILE+" is installed")
+	}
+	if _, err := os.Stat(RULES_PATH + LEGACY_RULES_FILE); err == nil {
+		d.warn("udev rules", RULES_PATH+LEGACY_RULES_FILE+" runs too late for uaccess, run: sudo "+os.Args[0]+" udev install")
+	}
+	for _, problem := range newUSBDiagnostics().run() {
+		if problem.Device == nil {
+			d.warn("USB access", problem.Problem)
+			continue
+		}
+		d.problem("USB access", problem.Device.Product+" "+problem.Device.SerialNumber+": "+problem.Problem)
+		for _, remedy := range problem.Remedy {
+			fmt.Println("         - " + remedy)
+		}
+	}
+}
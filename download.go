@@ -0,0 +1,261 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	DOWNLOAD_ATTEMPTS     = 5
+	DOWNLOAD_BACKOFF      = 2 * time.Second
+	DOWNLOAD_MAX_BACKOFF  = time.Minute
+	DOWNLOAD_TIMEOUT      = 30 * time.Minute
+	DOWNLOAD_IDLE_TIMEOUT = time.Minute
+	PARTIAL_SUFFIX        = ".part"
+)
+
+var errChecksumMismatch = errors.New("sha256sum mismatch")
+var errDownloadStalled = fmt.Errorf("no data received for %v", DOWNLOAD_IDLE_TIMEOUT)
+
+var (
+	proxyFlag    = flag.String("proxy", "", "Proxy URL for downloads, overriding HTTP_PROXY and HTTPS_PROXY")
+	caBundleFlag = flag.String("ca-bundle", "", "PEM file with extra CA certificates to trust for downloads, e.g. for a TLS-intercepting proxy")
+)
+
+var httpTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+}
+
+var httpClient = &http.Client{Transport: httpTransport}
+
+// configureHTTPClient applies the -proxy and -ca-bundle flags. Without them
+// the proxy environment variables and the system certificates are used.
+func configureHTTPClient() error {
+	if *proxyFlag != "" {
+		proxyURL, err := url.Parse(*proxyFlag)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL %q: %v", *proxyFlag, err)
+		}
+		httpTransport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if *caBundleFlag != "" {
+		pem, err := ioutil.ReadFile(*caBundleFlag)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", *caBundleFlag)
+		}
+		httpTransport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return nil
+}
+
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return e.url + ": unexpected HTTP status " + e.status
+}
+
+// downloadFile fetches url into destination, retrying transient failures with
+// exponential backoff. Data is written to destination.part first so that an
+// interrupted download can be resumed, and it is only renamed into place once
+// the whole file has been received and its sha256sum matches (if given).
+func downloadFile(url, destination, sha256sum string) error {
+	fmt.Println("Downloading " + url)
+	backoff := DOWNLOAD_BACKOFF
+	var err error
+	for attempt := 1; attempt <= DOWNLOAD_ATTEMPTS; attempt++ {
+		err = downloadAttempt(url, destination, sha256sum)
+		if err == nil || !isRetryableDownloadError(err) || attempt == DOWNLOAD_ATTEMPTS {
+			break
+		}
+		warnln(fmt.Sprintf("Download failed: %v. Retrying in %v...", err, backoff))
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > DOWNLOAD_MAX_BACKOFF {
+			backoff = DOWNLOAD_MAX_BACKOFF
+		}
+	}
+	// Keep a partial download around for the next run, unless nothing was received
+	if info, statErr := os.Stat(destination + PARTIAL_SUFFIX); err != nil && statErr == nil && info.Size() == 0 {
+		_ = os.Remove(destination + PARTIAL_SUFFIX)
+	}
+	return err
+}
+
+func downloadAttempt(url, destination, sha256sum string) error {
+	partial := destination + PARTIAL_SUFFIX
+	out, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Hash what we already have, which also leaves the offset at the end of the file
+	h := sha256.New()
+	offset, err := io.Copy(h, out)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DOWNLOAD_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server ignored the range request, start over
+		if offset > 0 {
+			if err = restartPartial(out); err != nil {
+				return err
+			}
+			h.Reset()
+			offset = 0
+		}
+	case http.StatusPartialContent:
+		if !contentRangeStartsAt(resp.Header.Get("Content-Range"), offset) {
+			_ = restartPartial(out)
+			return fmt.Errorf("%s: unexpected Content-Range %q", url, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing left to fetch, the partial file should already be complete
+		if offset == 0 {
+			return &httpStatusError{url, resp.Status, resp.StatusCode}
+		}
+		return finishDownload(out, partial, destination, h.Sum(nil), sha256sum)
+	default:
+		return &httpStatusError{url, resp.Status, resp.StatusCode}
+	}
+
+	var size uint64
+	if resp.ContentLength >= 0 {
+		size = uint64(offset + resp.ContentLength)
+	}
+	counter := NewWriteCounter(uint64(offset), size)
+	body := newIdleTimeoutReader(resp.Body, DOWNLOAD_IDLE_TIMEOUT, cancel)
+	defer body.Stop()
+	_, err = io.Copy(out, io.TeeReader(body, io.MultiWriter(h, counter)))
+	counter.Finish()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return errDownloadStalled
+		}
+		return err
+	}
+	return finishDownload(out, partial, destination, h.Sum(nil), sha256sum)
+}
+
+func finishDownload(out *os.File, partial, destination string, sum []byte, sha256sum string) error {
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if sha256sum != "" && hex.EncodeToString(sum) != sha256sum {
+		_ = os.Remove(partial)
+		return errChecksumMismatch
+	}
+	return os.Rename(partial, destination)
+}
+
+func restartPartial(out *os.File) error {
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+	_, err := out.Seek(0, io.SeekStart)
+	return err
+}
+
+func contentRangeStartsAt(contentRange string, offset int64) bool {
+	var start, end int64
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end)
+	return err == nil && start == offset
+}
+
+func isRetryableDownloadError(err error) bool {
+	// Downloading again would get the same file, e.g. from a bad mirror or
+	// with a stale checksum in the catalogue
+	if errors.Is(err, errChecksumMismatch) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500 || statusErr.code == http.StatusRequestTimeout || statusErr.code == http.StatusTooManyRequests
+	}
+	var pathErr *os.PathError
+	return !errors.As(err, &pathErr)
+}
+
+// idleTimeoutReader cancels the download if the server stops sending data,
+// since the overall timeout is necessarily generous for large files.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	return &idleTimeoutReader{r: r, timeout: timeout, timer: time.AfterFunc(timeout, cancel)}
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+func (r *idleTimeoutReader) Stop() {
+	r.timer.Stop()
+}
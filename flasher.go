@@ -17,57 +17,54 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
-	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
-	"time"
 )
 
-var input string
-
 var executable, _ = os.Executable()
 var cwd = filepath.Dir(executable)
 
 var adb *exec.Cmd
 var fastboot *exec.Cmd
 
-var platformToolsVersion = "30.0.4"
+var platformToolsVersion string
 var platformToolsZip string
 
 var deviceFactoryFolderMap map[string]string
 
+var (
+	imageDirsFlag = flag.String("image-dirs", "", "Comma-separated directories to look for factory images in, besides the flasher's own")
+	errorLogFlag  = flag.String("error-log", "error.log", "File to log errors to")
+)
+
 // Set via LDFLAGS, check Makefile
 var version string
 
 const OS = runtime.GOOS
 
-const (
-	UDEV_RULES = "# Google\nSUBSYSTEM==\"usb\", ATTR{idVendor}==\"18d1\", GROUP=\"sudo\"\n# Xiaomi\nSUBSYSTEM==\"usb\", ATTR{idVendor}==\"2717\", GROUP=\"sudo\"\n"
-	RULES_FILE = "98-device-flasher.rules"
-	RULES_PATH = "/etc/udev/rules.d/"
-)
-
 var (
 	Error = Red
 	Warn  = Yellow
 )
 
 var (
-	Blue   = Color("\033[1;34m%s\033[0m")
-	Red    = Color("\033[1;31m%s\033[0m")
-	Yellow = Color("\033[1;33m%s\033[0m")
+	Blue    = Color("\033[1;34m%s\033[0m")
+	Cyan    = Color("\033[1;36m%s\033[0m")
+	Green   = Color("\033[1;32m%s\033[0m")
+	Magenta = Color("\033[1;35m%s\033[0m")
+	Red     = Color("\033[1;31m%s\033[0m")
+	Yellow  = Color("\033[1;33m%s\033[0m")
 )
 
 func Color(color string) func(...interface{}) string {
@@ -78,54 +75,80 @@ func Color(color string) func(...interface{}) string {
 }
 
 func errorln(err interface{}, fatal bool) {
-	log, _ := os.OpenFile("error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	_, _ = fmt.Fprintln(log, err)
+	logError(err)
 	_, _ = fmt.Fprintln(os.Stderr, Error(err))
-	log.Close()
 	if fatal {
 		cleanup()
 		fmt.Println("Press enter to exit.")
-		_, _ = fmt.Scanln(&input)
+		_, _ = stdin.readLine(nil)
 		os.Exit(1)
 	}
 }
 
+func logError(err interface{}) {
+	log, _ := os.OpenFile(*errorLogFlag, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	_, _ = fmt.Fprintln(log, err)
+	log.Close()
+}
+
 func warnln(warning interface{}) {
 	fmt.Println(Warn(warning))
 }
 
 func cleanup() {
-	if OS == "linux" {
-		_, err := os.Stat(RULES_PATH + RULES_FILE)
-		if !os.IsNotExist(err) {
-			_ = exec.Command("sudo", "rm", RULES_PATH+RULES_FILE).Run()
-		}
+	if adb != nil {
+		killPlatformTools()
 	}
 }
 
 func main() {
+	flag.Parse()
+	err := loadConfig()
+	if err != nil {
+		errorln(err, true)
+	}
+	if flag.NArg() > 0 {
+		os.Exit(runSubcommand(flag.Args()))
+	}
 	defer cleanup()
-	_ = os.Remove("error.log")
+	handleSignals()
+	_ = os.Remove(*errorLogFlag)
 	fmt.Println("Android Factory Image Flasher version " + version)
+	err = policy{Unlock: *unlockPolicyFlag, Lock: *lockPolicyFlag}.validate()
+	if err != nil {
+		errorln(err, true)
+	}
+	err = validateRetryPolicy()
+	if err != nil {
+		errorln(err, true)
+	}
+	if *uiFlag != UI_PLAIN && *uiFlag != UI_TUI {
+		errorln(fmt.Errorf("invalid -ui %q, expected plain or tui", *uiFlag), true)
+	}
+	err = loadDeviceProfiles()
+	if err != nil {
+		errorln(err, true)
+	}
 	// Map device codenames to their corresponding extracted factory image folders
 	deviceFactoryFolderMap = getFactoryFolders()
 	if len(deviceFactoryFolderMap) < 1 {
 		errorln(errors.New("Cannot continue without a device factory image. Exiting..."), true)
 	}
-	err := getPlatformTools()
+	err = configureHTTPClient()
+	if err != nil {
+		errorln(err, true)
+	}
+	err = getPlatformTools()
 	if err != nil {
 		errorln("Cannot continue without Android platform tools. Exiting...", false)
 		errorln(err, true)
 	}
 	if OS == "linux" {
-		// Linux weirdness
+		// Devices are only accessible to root without udev rules
 		checkUdevRules()
 	}
-	platformToolCommand := *adb
-	platformToolCommand.Args = append(adb.Args, "start-server")
-	err = platformToolCommand.Run()
+	err = startAdbServer()
 	if err != nil {
-		errorln("Cannot start ADB server", false)
 		errorln(err, true)
 	}
 	warnln("1. Connect to a wifi network and ensure that no SIM cards are installed")
@@ -134,172 +157,139 @@ func main() {
 	warnln("4. Enable OEM Unlocking (in the same Developer Options menu)")
 	fmt.Println()
 	fmt.Print(Warn("Press ENTER to continue"))
-	_, _ = fmt.Scanln(&input)
+	_, _ = stdin.readLine(nil)
 	fmt.Println()
 	// Map serial numbers to device codenames by extracting them from adb and fastboot command output
-	devices := getDevices()
+	devices, err := selectDevices(getDevices())
+	if err != nil {
+		errorln(err, true)
+	}
 	if len(devices) == 0 {
 		errorln(errors.New("No devices to be flashed. Exiting..."), true)
-	} else if !PARALLEL && len(devices) > 1 {
-		errorln(errors.New("More than one device detected. Exiting..."), true)
 	}
 	fmt.Println()
 	fmt.Println("Devices to be flashed: ")
 	for serialNumber, device := range devices {
 		fmt.Println(device + " " + serialNumber)
 	}
-	fmt.Println()
-	fmt.Print(Warn("Press ENTER to continue"))
-	_, _ = fmt.Scanln(&input)
+	if *dryRunFlag {
+		fmt.Println("Dry run, nothing will be changed. Commands that would be run:")
+		if !printPlan(devices) {
+			cleanup()
+			os.Exit(1)
+		}
+		return
+	}
+	if *uiFlag != UI_TUI {
+		fmt.Println()
+		fmt.Print(Warn("Press ENTER to continue"))
+		_, _ = stdin.readLine(nil)
+	}
 	// Sequence: unlock bootloader -> execute flash-all script -> relock bootloader
 	flashDevices(devices)
-}
-
-func getFactoryFolders() map[string]string {
-	files, err := ioutil.ReadDir(cwd)
-	if err != nil {
-		errorln(err, true)
-	}
-	deviceFactoryFolderMap := map[string]string{}
-	for _, file := range files {
-		file := file.Name()
-		if strings.Contains(file, "factory") && strings.HasSuffix(file, ".zip") {
-			if strings.HasPrefix(file, "jasmine") {
-				platformToolsVersion = "29.0.6"
-			}
-			extracted, err := extractZip(path.Base(file), cwd)
-			if err != nil {
-				errorln("Cannot continue without a factory image. Exiting...", false)
-				errorln(err, true)
-			}
-			device := strings.Split(file, "-")[0]
-			if _, exists := deviceFactoryFolderMap[device]; !exists {
-				deviceFactoryFolderMap[device] = extracted[0]
-			} else {
-				errorln("More than one factory image available for "+device, true)
-			}
-		}
+	if interrupted() {
+		cleanup()
+		os.Exit(EXIT_INTERRUPTED)
 	}
-	return deviceFactoryFolderMap
 }
 
-func getPlatformTools() error {
-	plaformToolsUrlMap := map[[2]string]string{
-		[2]string{"darwin", "29.0.6"}:  "https://dl.google.com/android/repository/platform-tools_r29.0.6-darwin.zip",
-		[2]string{"linux", "29.0.6"}:   "https://dl.google.com/android/repository/platform-tools_r29.0.6-linux.zip",
-		[2]string{"windows", "29.0.6"}: "https://dl.google.com/android/repository/platform-tools_r29.0.6-windows.zip",
-		[2]string{"darwin", "30.0.4"}:  "https://dl.google.com/android/repository/fbad467867e935dce68a0296b00e6d1e76f15b15.platform-tools_r30.0.4-darwin.zip",
-		[2]string{"linux", "30.0.4"}:   "https://dl.google.com/android/repository/platform-tools_r30.0.4-linux.zip",
-		[2]string{"windows", "30.0.4"}: "https://dl.google.com/android/repository/platform-tools_r30.0.4-windows.zip",
-	}
-	platformToolsChecksumMap := map[[2]string]string{
-		[2]string{"darwin", "29.0.6"}:  "7555e8e24958cae4cfd197135950359b9fe8373d4862a03677f089d215119a3a",
-		[2]string{"linux", "29.0.6"}:   "cc9e9d0224d1a917bad71fe12d209dfffe9ce43395e048ab2f07dcfc21101d44",
-		[2]string{"windows", "29.0.6"}: "247210e3c12453545f8e1f76e55de3559c03f2d785487b2e4ac00fe9698a039c",
-		[2]string{"darwin", "30.0.4"}:  "e0db2bdc784c41847f854d6608e91597ebc3cef66686f647125f5a046068a890",
-		[2]string{"linux", "30.0.4"}:   "5be24ed897c7e061ba800bfa7b9ebb4b0f8958cc062f4b2202701e02f2725891",
-		[2]string{"windows", "30.0.4"}: "413182fff6c5957911e231b9e97e6be4fc6a539035e3dfb580b5c54bd5950fee",
-	}
-	platformToolsOsVersion := [2]string{OS, platformToolsVersion}
-	_, err := os.Stat(path.Base(plaformToolsUrlMap[platformToolsOsVersion]))
-	if err != nil {
-		err = downloadFile(plaformToolsUrlMap[platformToolsOsVersion])
-		if err != nil {
-			return err
+// imageDirs returns the flasher's own directory and those of -image-dirs
+func imageDirs() []string {
+	dirs := []string{cwd}
+	if *imageDirsFlag != "" {
+		for _, dir := range strings.Split(*imageDirsFlag, ",") {
+			dirs = append(dirs, strings.TrimSpace(dir))
 		}
 	}
-	platformToolsZip = path.Base(plaformToolsUrlMap[platformToolsOsVersion])
-	err = verifyZip(platformToolsZip, platformToolsChecksumMap[platformToolsOsVersion])
-	if err != nil {
-		fmt.Println(platformToolsZip + " checksum verification failed")
-		return err
-	}
-	platformToolsPath := cwd + string(os.PathSeparator) + "platform-tools" + string(os.PathSeparator)
-	pathEnvironmentVariable := func() string {
-		if OS == "windows" {
-			return "Path"
-		} else {
-			return "PATH"
-		}
-	}()
-	_ = os.Setenv(pathEnvironmentVariable, platformToolsPath+string(os.PathListSeparator)+os.Getenv(pathEnvironmentVariable))
-	adbPath := platformToolsPath + "adb"
-	fastbootPath := platformToolsPath + "fastboot"
-	if OS == "windows" {
-		adbPath += ".exe"
-		fastbootPath += ".exe"
-	}
-	adb = exec.Command(adbPath)
-	fastboot = exec.Command(fastbootPath)
-	// Ensure that no platform tools are running before attempting to overwrite them
-	killPlatformTools()
-	_, err = extractZip(platformToolsZip, cwd)
-	return err
+	return dirs
 }
 
-func checkUdevRules() {
-	_, err := os.Stat(RULES_PATH)
-	if os.IsNotExist(err) {
-		err = exec.Command("sudo", "mkdir", RULES_PATH).Run()
-		if err != nil {
-			errorln("Cannot continue without udev rules. Exiting...", false)
-			errorln(err, true)
-		}
-	}
-	_, err = os.Stat(RULES_FILE)
-	if os.IsNotExist(err) {
-		err = ioutil.WriteFile(RULES_FILE, []byte(UDEV_RULES), 0644)
+func getFactoryFolders() map[string]string {
+	deviceFactoryFolderMap := map[string]string{}
+	for _, dir := range imageDirs() {
+		files, err := ioutil.ReadDir(dir)
 		if err != nil {
-			errorln("Cannot continue without udev rules. Exiting...", false)
 			errorln(err, true)
 		}
-		err = exec.Command("sudo", "cp", RULES_FILE, RULES_PATH).Run()
-		if err != nil {
-			errorln("Cannot continue without udev rules. Exiting...", false)
-			errorln(err, true)
+		for _, file := range files {
+			file := file.Name()
+			if strings.Contains(file, "factory") && strings.HasSuffix(file, ".zip") {
+				extracted, err := extractZip(filepath.Join(dir, file), dir)
+				if err != nil {
+					errorln("Cannot continue without a factory image. Exiting...", false)
+					errorln(err, true)
+				}
+				device := getProfile(strings.Split(file, "-")[0]).Codename
+				if _, exists := deviceFactoryFolderMap[device]; !exists {
+					deviceFactoryFolderMap[device] = extracted[0]
+				} else {
+					errorln("More than one factory image available for "+device, true)
+				}
+			}
 		}
-		_ = exec.Command("sudo", "udevadm", "control", "--reload-rules").Run()
-		_ = exec.Command("sudo", "udevadm", "trigger").Run()
 	}
+	return deviceFactoryFolderMap
 }
 
 func getDevices() map[string]string {
+	return findDevices(func(string) bool { return false })
+}
+
+// findDevices is getDevices for the devices known does not report, which are
+// left alone rather than probed, e.g. while they are being flashed. Output
+// goes through the console so as not to get in the way of a TUI.
+func findDevices(known func(serialNumber string) bool) map[string]string {
 	devices := map[string]string{}
+	noPermissions := false
 	for _, platformToolCommand := range []exec.Cmd{*adb, *fastboot} {
 		platformToolCommand.Args = append(platformToolCommand.Args, "devices")
-		output, _ := platformToolCommand.Output()
+		output, err := commandOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+		if isTimeout(err) {
+			errorln(err, false)
+		}
 		lines := strings.Split(string(output), "\n")
 		if platformToolCommand.Path == adb.Path {
 			lines = lines[1:]
 		}
 		for i, device := range lines {
 			if lines[i] != "" && lines[i] != "\r" {
+				if strings.Contains(device, "no permissions") {
+					noPermissions = true
+				}
 				serialNumber := strings.Split(device, "\t")[0]
+				if known(serialNumber) {
+					continue
+				}
 				if platformToolCommand.Path == adb.Path {
 					device = getProp("ro.product.device", serialNumber)
 				} else if platformToolCommand.Path == fastboot.Path {
 					device = getVar("product", serialNumber)
-					if device == "jasmine" {
-						device += "_sprout"
-					}
 				}
-				fmt.Print("Detected " + device + " " + serialNumber)
+				if device != "" {
+					device = getProfile(device).Codename
+				}
 				if _, ok := deviceFactoryFolderMap[device]; ok {
 					devices[serialNumber] = device
-					fmt.Println()
+					deviceln(serialNumber, "Detected "+device+" "+serialNumber)
 				} else {
-					fmt.Println(". " + "No matching factory image found")
+					deviceln(serialNumber, "Detected "+device+" "+serialNumber+". No matching factory image found")
 				}
 			}
 		}
 	}
+	if OS == "linux" && (noPermissions || len(devices) == 0) {
+		printUSBProblems(newUSBDiagnostics().run())
+	}
 	return devices
 }
 
 func getVar(prop string, device string) string {
 	platformToolCommand := *fastboot
 	platformToolCommand.Args = append(fastboot.Args, "-s", device, "getvar", prop)
-	out, err := platformToolCommand.CombinedOutput()
+	out, err := commandCombinedOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if isTimeout(err) {
+		errorln(err, false)
+	}
 	if err != nil {
 		return ""
 	}
@@ -315,7 +305,10 @@ func getVar(prop string, device string) string {
 func getProp(prop string, device string) string {
 	platformToolCommand := *adb
 	platformToolCommand.Args = append(adb.Args, "-s", device, "shell", "getprop", prop)
-	out, err := platformToolCommand.Output()
+	out, err := commandOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if isTimeout(err) {
+		errorln(err, false)
+	}
 	if err != nil {
 		return ""
 	}
@@ -323,108 +316,230 @@ func getProp(prop string, device string) string {
 }
 
 func flashDevices(devices map[string]string) {
-	var wg sync.WaitGroup
+	console.setDevices(devices)
+	st := newStation()
 	for serialNumber, device := range devices {
-		wg.Add(1)
-		go func(serialNumber, device string) {
-			defer wg.Done()
-			platformToolCommand := *adb
-			platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot", "bootloader")
-			_ = platformToolCommand.Run()
-			fmt.Println("Unlocking " + device + " " + serialNumber + " bootloader...")
-			warnln("5. Please use the volume and power keys on the device to unlock the bootloader")
-			if device == "jasmine" || device == "walleye" {
-				fmt.Println()
-				warnln("  5a. Once " + device + " " + serialNumber + " boots, disconnect its cable and power it off")
-				warnln("  5b. Then, press volume down + power to boot it into fastboot mode, and connect the cable again.")
-				fmt.Println("The installation will resume automatically")
-			}
-			for i := 0; getVar("unlocked", serialNumber) != "yes"; i++ {
-				platformToolCommand = *fastboot
-				platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "unlock")
-				_ = platformToolCommand.Start()
-				time.Sleep(30 * time.Second)
-				if i >= 2 {
-					errorln("Failed to unlock "+device+" "+serialNumber+" bootloader", false)
-					return
-				}
-			}
-			fmt.Println("Flashing " + device + " " + serialNumber + " bootloader...")
-			flashAll := exec.Command("." + string(os.PathSeparator) + "flash-all" + func() string {
-				if OS == "windows" {
-					return ".bat"
-				} else {
-					return ".sh"
-				}
-			}())
-			flashAll.Dir = deviceFactoryFolderMap[device]
-			flashAll.Stderr = os.Stderr
-			err := flashAll.Run()
-			if err != nil {
-				errorln("Failed to flash "+device+" "+serialNumber, false)
-				errorln(err.Error(), false)
-				return
-			}
-			fmt.Println("Locking " + device + " " + serialNumber + " bootloader...")
-			warnln("6. Please use the volume and power keys on the device to lock the bootloader")
-			if device == "jasmine" || device == "walleye" {
-				fmt.Println()
-				warnln("  6a. Once " + device + " " + serialNumber + " boots, disconnect its cable and power it off")
-				warnln("  6b. Then, press volume down + power to boot it into fastboot mode, and connect the cable again.")
-				fmt.Println("The installation will resume automatically")
-			}
-			for i := 0; getVar("unlocked", serialNumber) != "no"; i++ {
-				platformToolCommand = *fastboot
-				platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "flashing", "lock")
-				_ = platformToolCommand.Start()
-				time.Sleep(30 * time.Second)
-				if i >= 2 {
-					errorln("Failed to lock "+device+" "+serialNumber+" bootloader", false)
-					return
-				}
-			}
-			fmt.Println("Rebooting " + device + " " + serialNumber + "...")
-			platformToolCommand = *fastboot
-			platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot")
-			_ = platformToolCommand.Start()
-			warnln("7. Disable OEM unlocking from Developer Options after setting up your device")
-		}(serialNumber, device)
-	}
-	wg.Wait()
+		st.add(serialNumber, device)
+	}
+	watchShutdown(st)
+	if *httpFlag != "" {
+		server, dashboardURL, err := serveDashboard(*httpFlag, stationBackend{st})
+		if err != nil {
+			errorln("Cannot serve the dashboard on "+*httpFlag, false)
+			errorln(err, false)
+		} else {
+			fmt.Println("Dashboard available at " + dashboardURL)
+			defer server.Close()
+		}
+	}
+	tui := *uiFlag == UI_TUI
+	if tui {
+		err := runTUI(st)
+		if err != nil {
+			warnln("Cannot show the TUI: " + err.Error())
+			tui = false
+		}
+	}
+	if !tui {
+		stopTable := console.startTable()
+		for serialNumber := range devices {
+			_ = st.start(serialNumber)
+		}
+		st.wait()
+		stopTable()
+		if *httpFlag != "" && !interrupted() {
+			// Devices may still be retried or discovered from the dashboard
+			fmt.Println()
+			fmt.Print(Warn("Press ENTER to finish"))
+			_, _ = stdin.readLine(nil)
+			st.wait()
+		}
+	}
 	fmt.Println()
-	fmt.Println(Blue("Flashing complete"))
-}
-
-func killPlatformTools() {
-	_, err := os.Stat(adb.Path)
-	if err == nil {
-		platformToolCommand := *adb
-		platformToolCommand.Args = append(platformToolCommand.Args, "kill-server")
-		_ = platformToolCommand.Run()
+	if interrupted() {
+		fmt.Println(Warn("Flashing interrupted"))
+	} else {
+		fmt.Println(Blue("Flashing complete"))
 	}
-	if OS == "windows" {
-		_ = exec.Command("taskkill", "/IM", "fastboot.exe", "/F").Run()
+	report.print()
+	err := report.save(*reportFlag)
+	if err != nil {
+		errorln("Cannot save report to "+*reportFlag, false)
+		errorln(err, false)
 	}
 }
 
-func downloadFile(url string) error {
-	fmt.Println("Downloading " + url)
-	resp, err := http.Get(url)
+func flashDevice(ctx context.Context, serialNumber, device string) error {
+	profile := getProfile(device)
+	devicePolicy := getPolicy(serialNumber, device)
+	metadata, err := readFactoryMetadata(deviceFactoryFolderMap[device])
+	if err != nil {
+		return fmt.Errorf("cannot read factory image metadata: %v", err)
+	}
+	err = beginStep(serialNumber, STEP_REBOOT_BOOTLOADER)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	out, err := os.Create(path.Base(url))
+	platformToolCommand := *adb
+	platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot", "bootloader")
+	_ = runCommand(ctx, COMMAND_TIMEOUT, &platformToolCommand)
+	err = waitForFastboot(ctx, serialNumber, REBOOT_TIMEOUT)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	counter := &WriteCounter{}
-	_, err = io.Copy(out, io.TeeReader(resp.Body, counter))
-	fmt.Println()
-	return err
+	err = beginStep(serialNumber, STEP_UNLOCK)
+	if err != nil {
+		return err
+	}
+	unlocked := getLockState(serialNumber, false) == "yes"
+	switch {
+	case devicePolicy.Unlock == UNLOCK_REQUIRE && unlocked:
+		return errors.New("bootloader is already unlocked and the unlock policy is require")
+	case devicePolicy.Unlock == UNLOCK_SKIP && !unlocked:
+		return errors.New("bootloader is locked and the unlock policy is skip")
+	case unlocked:
+		deviceln(serialNumber, device+" "+serialNumber+" bootloader is already unlocked")
+	default:
+		deviceln(serialNumber, "Unlocking "+device+" "+serialNumber+" bootloader...")
+		console.once("unlock", "5. Please use the volume and power keys on the device to unlock the bootloader")
+		if profile.ManualFastboot {
+			console.once("unlock "+device,
+				"  5a. Once a "+device+" boots, disconnect its cable and power it off",
+				"  5b. Then, "+profile.Instructions+", and connect the cable again.",
+				"The installation will resume automatically")
+		}
+		err = setLockState(ctx, serialNumber, profile, true, false)
+		if err != nil {
+			return fmt.Errorf("cannot unlock bootloader: %v", err)
+		}
+	}
+	if profile.UnlockCritical {
+		switch state := getLockState(serialNumber, true); {
+		case state == "yes":
+		case devicePolicy.Unlock == UNLOCK_SKIP && state == "no":
+			return errors.New("critical partitions are locked and the unlock policy is skip")
+		case devicePolicy.Unlock == UNLOCK_SKIP:
+			deviceWarnln(serialNumber, "Cannot read the critical partitions lock state of "+device+" "+serialNumber+", assuming they are unlocked")
+		default:
+			deviceln(serialNumber, "Unlocking "+device+" "+serialNumber+" critical partitions...")
+			console.once("unlock_critical", "Please use the volume and power keys on the device to unlock critical partitions")
+			err = setLockState(ctx, serialNumber, profile, true, true)
+			if err != nil {
+				return fmt.Errorf("cannot unlock critical partitions: %v", err)
+			}
+		}
+	}
+	err = verifyLockState(serialNumber, profile, true)
+	if err != nil {
+		return err
+	}
+	err = retryStep(ctx, serialNumber, device, func() error {
+		err := beginStep(serialNumber, STEP_FLASH_QUEUED)
+		if err != nil {
+			return err
+		}
+		err = flashLimiter.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer flashLimiter.release()
+		err = beginStep(serialNumber, STEP_FLASH)
+		if err != nil {
+			return err
+		}
+		deviceln(serialNumber, "Flashing "+device+" "+serialNumber+" bootloader...")
+		flashAll := exec.Command("." + string(os.PathSeparator) + "flash-all" + func() string {
+			if OS == "windows" {
+				return ".bat"
+			} else {
+				return ".sh"
+			}
+		}())
+		flashAll.Dir = deviceFactoryFolderMap[device]
+		output := &tailBuffer{}
+		writer := console.writer(serialNumber)
+		flashAll.Stderr = io.MultiWriter(writer, output)
+		err = runCommand(ctx, FLASH_ALL_TIMEOUT, flashAll)
+		writer.Flush()
+		if err != nil {
+			return &stepError{err: err, output: output.String()}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = beginStep(serialNumber, STEP_VERIFY)
+	if err != nil {
+		return err
+	}
+	deviceln(serialNumber, "Verifying "+device+" "+serialNumber+" build...")
+	err = waitForFastboot(ctx, serialNumber, *confirmTimeoutFlag)
+	if err == nil {
+		err = verifyFlashedBuild(serialNumber, metadata)
+	}
+	if err != nil {
+		// Locking a device with a mismatched build can brick it
+		return fmt.Errorf("build verification failed, not locking bootloader: %v", err)
+	}
+	lock := devicePolicy.Lock == LOCK_ALWAYS || (devicePolicy.Lock == LOCK_ASK && confirmLock(serialNumber, device))
+	if lock {
+		err = beginStep(serialNumber, STEP_LOCK)
+		if err != nil {
+			return err
+		}
+		if profile.UnlockCritical {
+			// Critical partitions can no longer be locked once the bootloader is
+			// locked, so they have to be locked first
+			deviceln(serialNumber, "Locking "+device+" "+serialNumber+" critical partitions...")
+			console.once("lock_critical", "Please use the volume and power keys on the device to lock critical partitions")
+			err = setLockState(ctx, serialNumber, profile, false, true)
+			if err != nil {
+				return fmt.Errorf("cannot lock critical partitions: %v", err)
+			}
+		}
+		deviceln(serialNumber, "Locking "+device+" "+serialNumber+" bootloader...")
+		console.once("lock", "6. Please use the volume and power keys on the device to lock the bootloader")
+		if profile.ManualFastboot {
+			console.once("lock "+device,
+				"  6a. Once a "+device+" boots, disconnect its cable and power it off",
+				"  6b. Then, "+profile.Instructions+", and connect the cable again.",
+				"The installation will resume automatically")
+		}
+		err = setLockState(ctx, serialNumber, profile, false, false)
+		if err != nil {
+			return fmt.Errorf("cannot lock bootloader: %v", err)
+		}
+		err = verifyLockState(serialNumber, profile, false)
+		if err != nil {
+			return err
+		}
+	} else {
+		deviceln(serialNumber, "Leaving "+device+" "+serialNumber+" bootloader unlocked")
+	}
+	report.locked(serialNumber, lock)
+	err = beginStep(serialNumber, STEP_REBOOT)
+	if err != nil {
+		return err
+	}
+	deviceln(serialNumber, "Rebooting "+device+" "+serialNumber+"...")
+	platformToolCommand = *fastboot
+	platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot")
+	_ = runCommand(ctx, COMMAND_TIMEOUT, &platformToolCommand)
+	if lock {
+		console.once("locked", "7. Disable OEM unlocking from Developer Options after setting up your device")
+	}
+	if *waitBootFlag {
+		err = beginStep(serialNumber, STEP_BOOT)
+		if err != nil {
+			return err
+		}
+		deviceln(serialNumber, "Waiting for "+device+" "+serialNumber+" to boot...")
+		boot := waitForBoot(ctx, serialNumber, metadata, *bootTimeoutFlag)
+		report.booted(serialNumber, boot)
+		deviceln(serialNumber, device+" "+serialNumber+": "+boot)
+	}
+	return nil
 }
 
 func extractZip(src string, destination string) ([]string, error) {
@@ -485,45 +600,5 @@ func verifyZip(zipfile, sha256sum string) error {
 	if sha256sum == sum {
 		return nil
 	}
-	return errors.New("sha256sum mismatch")
-}
-
-type WriteCounter struct {
-	Total uint64
-}
-
-func (wc *WriteCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	wc.Total += uint64(n)
-	wc.PrintProgress()
-	return n, nil
-}
-
-func (wc WriteCounter) PrintProgress() {
-	fmt.Printf("\r%s", strings.Repeat(" ", 35))
-	fmt.Printf("\rDownloading... %s downloaded", Bytes(wc.Total))
-}
-
-func logn(n, b float64) float64 {
-	return math.Log(n) / math.Log(b)
-}
-
-func humanateBytes(s uint64, base float64, sizes []string) string {
-	if s < 10 {
-		return fmt.Sprintf("%d B", s)
-	}
-	e := math.Floor(logn(float64(s), base))
-	suffix := sizes[int(e)]
-	val := math.Floor(float64(s)/math.Pow(base, e)*10+0.5) / 10
-	f := "%.0f %s"
-	if val < 10 {
-		f = "%.1f %s"
-	}
-
-	return fmt.Sprintf(f, val, suffix)
-}
-
-func Bytes(s uint64) string {
-	sizes := []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
-	return humanateBytes(s, 1000, sizes)
+	return errChecksumMismatch
 }
@@ -0,0 +1,133 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for the rest of an escape sequence, e.g. an arrow key
+const ESCAPE_TIMEOUT = 10 * time.Millisecond
+
+var errInputCanceled = errors.New("input canceled")
+
+var stdin = &stdinReader{}
+
+// stdinReader is the only reader of stdin. Whoever is prompting reads lines,
+// or keys in raw mode, from it, and gives up when told to without taking
+// anything: input read but not used is put back for the next reader. This way
+// an abandoned prompt or a TUI that has exited does not swallow input meant
+// for later.
+type stdinReader struct {
+	sync.Mutex
+	once    sync.Once
+	bytes   chan byte
+	pending []byte
+}
+
+func (r *stdinReader) read() {
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		for _, b := range buf[:n] {
+			r.bytes <- b
+		}
+		if err != nil {
+			close(r.bytes)
+			return
+		}
+	}
+}
+
+// next returns the next byte of input, or errInputCanceled once cancel is
+// closed, or io.EOF
+func (r *stdinReader) next(cancel <-chan struct{}, timeout <-chan time.Time) (byte, error) {
+	r.Lock()
+	if len(r.pending) > 0 {
+		b := r.pending[0]
+		r.pending = r.pending[1:]
+		r.Unlock()
+		return b, nil
+	}
+	r.Unlock()
+	r.once.Do(func() {
+		r.bytes = make(chan byte)
+		go r.read()
+	})
+	select {
+	case b, ok := <-r.bytes:
+		if !ok {
+			return 0, io.EOF
+		}
+		return b, nil
+	case <-cancel:
+		return 0, errInputCanceled
+	case <-timeout:
+		return 0, errInputCanceled
+	}
+}
+
+// unread puts input back for the next reader
+func (r *stdinReader) unread(input []byte) {
+	r.Lock()
+	defer r.Unlock()
+	r.pending = append(append([]byte(nil), input...), r.pending...)
+}
+
+// readLine returns the next line of input, without its line ending. A nil
+// cancel waits for as long as it takes.
+func (r *stdinReader) readLine(cancel <-chan struct{}) (string, error) {
+	var line []byte
+	for {
+		b, err := r.next(cancel, nil)
+		switch {
+		case err == errInputCanceled:
+			r.unread(line)
+			return "", err
+		case err != nil && len(line) > 0:
+			return strings.TrimRight(string(line), "\r"), nil
+		case err != nil:
+			return "", err
+		case b == '\n':
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// readKey returns the next key pressed in raw mode, with escape sequences
+// such as arrow keys whole
+func (r *stdinReader) readKey(cancel <-chan struct{}) (string, error) {
+	b, err := r.next(cancel, nil)
+	if err != nil || b != '\033' {
+		return string(b), err
+	}
+	key := []byte{b}
+	timeout := time.After(ESCAPE_TIMEOUT)
+	for len(key) < 3 {
+		b, err := r.next(cancel, timeout)
+		if err != nil {
+			break
+		}
+		key = append(key, b)
+	}
+	return string(key), nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var dryRunFlag = flag.Bool("dry-run", false, "Detect devices and check their factory images, then print the commands that would be run for each device without changing anything")
+
+// planDevice returns the commands flashDevice would run for a device, given
+// its current state and policy, without running any that change it
+func planDevice(serialNumber, device string) ([]string, error) {
+	profile := getProfile(device)
+	devicePolicy := getPolicy(serialNumber, device)
+	folder := deviceFactoryFolderMap[device]
+	metadata, err := readFactoryMetadata(folder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read factory image metadata: %v", err)
+	}
+	fastbootCommand := func(args ...string) string {
+		platformToolCommand := *fastboot
+		platformToolCommand.Args = append(append(platformToolCommand.Args, "-s", serialNumber), args...)
+		return commandString(&platformToolCommand)
+	}
+	platformToolCommand := *adb
+	platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot", "bootloader")
+	reboot := commandString(&platformToolCommand)
+	inFastboot := fastbootDeviceConnected(serialNumber)
+	if inFastboot {
+		reboot += "  # already in fastboot mode"
+	}
+	plan := []string{reboot}
+
+	// The lock state can only be read in fastboot mode, and waiting for it
+	// otherwise would only time out
+	unlocked := ""
+	if inFastboot {
+		unlocked = getLockState(serialNumber, false)
+	}
+	switch {
+	case unlocked == "yes" && devicePolicy.Unlock == UNLOCK_REQUIRE:
+		return plan, fmt.Errorf("bootloader is already unlocked and the unlock policy is require")
+	case unlocked == "no" && devicePolicy.Unlock == UNLOCK_SKIP:
+		return plan, fmt.Errorf("bootloader is locked and the unlock policy is skip")
+	case unlocked == "yes":
+		plan = append(plan, "# bootloader already unlocked")
+	case unlocked == "" && devicePolicy.Unlock == UNLOCK_SKIP:
+		plan = append(plan, "# bootloader must already be unlocked")
+	default:
+		if unlocked == "" {
+			plan = append(plan, "# unless the bootloader is already unlocked:")
+		}
+		plan = append(plan, fastbootCommand(profile.Unlock, "unlock"))
+	}
+	if profile.UnlockCritical && devicePolicy.Unlock != UNLOCK_SKIP {
+		plan = append(plan, "# unless critical partitions are already unlocked:", fastbootCommand(UNLOCK_FLASHING, "unlock_critical"))
+	}
+
+	script := "flash-all.sh"
+	if OS == "windows" {
+		script = "flash-all.bat"
+	}
+	plan = append(plan, "cd "+folder, "."+string(os.PathSeparator)+script)
+	commands, err := flashAllCommands(filepath.Join(folder, script))
+	if err != nil {
+		return plan, err
+	}
+	for _, command := range commands {
+		plan = append(plan, "  "+command)
+	}
+
+	for _, check := range []struct{ variable, expected string }{
+		{"version-bootloader", metadata.Bootloader},
+		{"version-baseband", metadata.Baseband},
+	} {
+		if check.expected != "" {
+			plan = append(plan, fastbootCommand("getvar", check.variable)+"  # expect "+check.expected)
+		}
+	}
+
+	switch devicePolicy.Lock {
+	case LOCK_NEVER:
+		plan = append(plan, "# bootloader left unlocked")
+	case LOCK_ASK:
+		plan = append(plan, "# if confirmed:")
+		fallthrough
+	default:
+		if profile.UnlockCritical {
+			plan = append(plan, fastbootCommand(UNLOCK_FLASHING, "lock_critical"))
+		}
+		plan = append(plan, fastbootCommand(profile.Unlock, "lock"))
+	}
+	plan = append(plan, fastbootCommand("reboot"))
+	if *waitBootFlag {
+		plan = append(plan, "# wait up to "+bootTimeoutFlag.String()+" for "+metadata.BuildID+" to boot")
+	}
+	return plan, nil
+}
+
+// flashAllCommands returns the fastboot commands of a flash-all script
+func flashAllCommands(script string) ([]string, error) {
+	f, err := os.Open(script)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var commands []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "fastboot") {
+			commands = append(commands, line)
+		}
+	}
+	return commands, scanner.Err()
+}
+
+// printPlan prints the plan of every device and returns false if any cannot
+// be flashed
+func printPlan(devices map[string]string) bool {
+	var serialNumbers []string
+	for serialNumber := range devices {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	sort.Strings(serialNumbers)
+	ok := true
+	for _, serialNumber := range serialNumbers {
+		device := devices[serialNumber]
+		fmt.Println()
+		fmt.Println(Blue(device + " " + serialNumber + ":"))
+		plan, err := planDevice(serialNumber, device)
+		for _, command := range plan {
+			fmt.Println("  " + command)
+		}
+		if err != nil {
+			fmt.Println(Error("  Cannot be flashed: " + err.Error()))
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var platformToolVersionPattern = regexp.MustCompile(`(?m)^(?:fastboot version|Version) (\d+(?:\.\d+)+)`)
+
+// Whether adb and fastboot are the user's own rather than extracted by us
+var systemPlatformTools bool
+
+// Whether the adb server on ANDROID_ADB_SERVER_PORT was started by us
+var startedAdbServer bool
+
+var (
+	adbPortFlag       = flag.Int("adb-port", 0, "Port for the flasher's own adb server (default: any free port), leaving the standard adb server alone")
+	platformToolsFlag = flag.String("platform-tools", "auto", "Where to get adb and fastboot from: auto (installed if compatible, else download), system or download")
+	mirrorFlag        = flag.String("mirror", "", "Comma-separated platform-tools mirrors, as base URLs or local directories, tried before the upstream URL")
+	offlineFlag       = flag.Bool("offline", false, "Never download, only use platform-tools zips that are already present or in a local -mirror directory")
+)
+
+func getPlatformTools() error {
+	switch *platformToolsFlag {
+	case "auto", "system", "download":
+	default:
+		return fmt.Errorf("invalid -platform-tools %q, expected auto, system or download", *platformToolsFlag)
+	}
+	catalogue, err := loadPlatformToolsCatalogue()
+	if err != nil {
+		return err
+	}
+	var devices []*deviceProfile
+	for device := range deviceFactoryFolderMap {
+		devices = append(devices, getProfile(device))
+	}
+	release, err := catalogue.selectRelease(OS, runtime.GOARCH, devices)
+	if err != nil {
+		return err
+	}
+	if *platformToolsFlag != "download" {
+		// Any installed version at least as new as the one we would download will do
+		compatible := func(version string) bool {
+			return compareVersions(version, release.Version) >= 0 && platformToolsAllowed(version, devices)
+		}
+		adbPath, fastbootPath, version, err := findSystemPlatformTools(compatible)
+		if err == nil {
+			fmt.Println("Using installed platform tools " + version + " from " + filepath.Dir(fastbootPath))
+			platformToolsVersion = version
+			systemPlatformTools = true
+			usePlatformTools(adbPath, fastbootPath)
+			return nil
+		}
+		if *platformToolsFlag == "system" {
+			return err
+		}
+		fmt.Println(err.Error() + ", using platform tools " + release.Version)
+	}
+	platformToolsVersion = release.Version
+	platformToolsZip = path.Base(release.URL)
+	err = fetchPlatformTools(release.URL, release.SHA256)
+	if errors.Is(err, errChecksumMismatch) {
+		fmt.Println(platformToolsZip + " checksum verification failed")
+	}
+	if err != nil {
+		return err
+	}
+	platformToolsPath := filepath.Join(cwd, "platform-tools")
+	adbPath := filepath.Join(platformToolsPath, executableName("adb"))
+	fastbootPath := filepath.Join(platformToolsPath, executableName("fastboot"))
+	usePlatformTools(adbPath, fastbootPath)
+	// Binaries from a previous run may still be in use by another flasher instance,
+	// so only overwrite them when they are not the version we need
+	if platformToolVersion(adbPath, "version") == release.Version && platformToolVersion(fastbootPath, "--version") == release.Version {
+		return nil
+	}
+	_, err = extractZip(platformToolsZip, cwd)
+	return err
+}
+
+// usePlatformTools puts the given adb and fastboot first in PATH, so that the
+// factory image flash-all scripts run the same binaries as the flasher.
+func usePlatformTools(adbPath, fastbootPath string) {
+	pathEnvironmentVariable := func() string {
+		if OS == "windows" {
+			return "Path"
+		} else {
+			return "PATH"
+		}
+	}()
+	pathList := os.Getenv(pathEnvironmentVariable)
+	if adbDir := filepath.Dir(adbPath); adbDir != filepath.Dir(fastbootPath) {
+		pathList = adbDir + string(os.PathListSeparator) + pathList
+	}
+	_ = os.Setenv(pathEnvironmentVariable, filepath.Dir(fastbootPath)+string(os.PathListSeparator)+pathList)
+	adb = exec.Command(adbPath)
+	fastboot = exec.Command(fastbootPath)
+}
+
+// findSystemPlatformTools looks for adb and fastboot in PATH and in the SDK
+// pointed to by ANDROID_HOME or ANDROID_SDK_ROOT, returning the first pair
+// whose version is accepted by compatible.
+func findSystemPlatformTools(compatible func(version string) bool) (string, string, string, error) {
+	var dirs []string
+	if adbPath, err := exec.LookPath(executableName("adb")); err == nil {
+		dirs = append(dirs, filepath.Dir(adbPath))
+	}
+	for _, sdk := range []string{os.Getenv("ANDROID_HOME"), os.Getenv("ANDROID_SDK_ROOT")} {
+		if sdk != "" {
+			dirs = append(dirs, filepath.Join(sdk, "platform-tools"))
+		}
+	}
+	for _, dir := range dirs {
+		adbPath := filepath.Join(dir, executableName("adb"))
+		fastbootPath := filepath.Join(dir, executableName("fastboot"))
+		adbVersion := platformToolVersion(adbPath, "version")
+		fastbootVersion := platformToolVersion(fastbootPath, "--version")
+		if adbVersion == "" || fastbootVersion == "" {
+			continue
+		}
+		if !compatible(adbVersion) || !compatible(fastbootVersion) {
+			fmt.Println("Ignoring incompatible platform tools " + fastbootVersion + " in " + dir)
+			continue
+		}
+		return adbPath, fastbootPath, fastbootVersion, nil
+	}
+	return "", "", "", errors.New("no compatible installed platform tools found")
+}
+
+// platformToolVersion runs a platform tool's version command and extracts the
+// platform-tools release, e.g. 30.0.4 from "Version 30.0.4-6686687".
+func platformToolVersion(tool string, arg string) string {
+	out, err := commandOutput(context.Background(), COMMAND_TIMEOUT, exec.Command(tool, arg))
+	if err != nil {
+		return ""
+	}
+	match := platformToolVersionPattern.FindStringSubmatch(string(out))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+func executableName(name string) string {
+	if OS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// fetchPlatformTools makes sure a verified copy of the zip at url is present,
+// looking in the current directory first and then in each mirror in turn.
+func fetchPlatformTools(url, sha256sum string) error {
+	zipFile := path.Base(url)
+	if _, err := os.Stat(zipFile); err == nil {
+		return verifyZip(zipFile, sha256sum)
+	}
+	var sources []string
+	if *mirrorFlag != "" {
+		for _, mirror := range strings.Split(*mirrorFlag, ",") {
+			mirror = strings.TrimSpace(mirror)
+			if isURL(mirror) {
+				mirror = strings.TrimSuffix(mirror, "/") + "/" + zipFile
+			} else {
+				mirror = filepath.Join(mirror, zipFile)
+			}
+			sources = append(sources, mirror)
+		}
+	}
+	sources = append(sources, url)
+	var lastErr error
+	for _, source := range sources {
+		var err error
+		if isURL(source) {
+			if *offlineFlag {
+				continue
+			}
+			// The checksum is verified while downloading
+			err = downloadFile(source, zipFile, sha256sum)
+		} else {
+			err = copyFromMirror(source, zipFile, sha256sum)
+			if os.IsNotExist(err) {
+				continue
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		warnln(fmt.Sprintf("Cannot get %s: %v", source, err))
+		lastErr = err
+	}
+	if *offlineFlag {
+		return fmt.Errorf("offline mode: %s (sha256 %s) was not found in the current directory or any local mirror. "+
+			"Download it from %s on a connected machine and place it next to the flasher", zipFile, sha256sum, url)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%s was not found on any mirror", zipFile)
+	}
+	return lastErr
+}
+
+func copyFromMirror(src, destination, sha256sum string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fmt.Println("Copying " + src)
+	partial := destination + PARTIAL_SUFFIX
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyZip(partial, sha256sum)
+	}
+	if err != nil {
+		_ = os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, destination)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// useAdbServerPort makes every adb we run, including those run by flash-all
+// scripts, talk to a server of our own instead of the default one on 5037.
+func useAdbServerPort() error {
+	port := *adbPortFlag
+	if port == 0 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		port = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+	}
+	return os.Setenv("ANDROID_ADB_SERVER_PORT", strconv.Itoa(port))
+}
+
+// startAdbServer starts an adb server of our own, see useAdbServerPort
+func startAdbServer() error {
+	if err := useAdbServerPort(); err != nil {
+		return fmt.Errorf("cannot pick a port for the ADB server: %v", err)
+	}
+	platformToolCommand := *adb
+	platformToolCommand.Args = append(platformToolCommand.Args, "start-server")
+	out, err := commandCombinedOutput(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	if err != nil {
+		return fmt.Errorf("cannot start ADB server: %v", err)
+	}
+	// A server may already be listening on a port given with -adb-port, in
+	// which case it is not ours to stop
+	startedAdbServer = *adbPortFlag == 0 || strings.Contains(string(out), "daemon started successfully")
+	return nil
+}
+
+// killPlatformTools stops our own adb server and the platform tools we
+// started, leaving any other adb server or fastboot on the machine alone.
+func killPlatformTools() {
+	if startedAdbServer {
+		platformToolCommand := *adb
+		platformToolCommand.Args = append(platformToolCommand.Args, "kill-server")
+		_ = runCommand(context.Background(), COMMAND_TIMEOUT, &platformToolCommand)
+	}
+	killStartedProcesses()
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// Unlock the bootloader unless it already is
+	UNLOCK_AUTO = "auto"
+	// Never unlock, the bootloader must already be unlocked
+	UNLOCK_SKIP = "skip"
+	// The bootloader must start out locked and is always unlocked
+	UNLOCK_REQUIRE = "require"
+
+	LOCK_ALWAYS = "always"
+	LOCK_NEVER  = "never"
+	// Ask the operator for each device once it has been flashed
+	LOCK_ASK = "ask"
+)
+
+var (
+	unlockPolicyFlag = flag.String("unlock", UNLOCK_AUTO, "Bootloader unlock policy: auto, skip or require")
+	lockPolicyFlag   = flag.String("lock", LOCK_ALWAYS, "Bootloader lock policy after flashing: always, never or ask")
+	devicePolicies   = devicePolicyFlag{}
+)
+
+func init() {
+	flag.Var(devicePolicies, "device-policy", "Per-device policy overriding -unlock and -lock, as SERIAL_OR_CODENAME:unlock=POLICY,lock=POLICY (repeatable)")
+}
+
+// Only one device at a time may prompt the operator
+var promptMutex sync.Mutex
+
+type policy struct {
+	Unlock string `json:"unlock"`
+	Lock   string `json:"lock"`
+}
+
+// devicePolicyFlag maps serial numbers and codenames to their policies
+type devicePolicyFlag map[string]policy
+
+func (f devicePolicyFlag) String() string {
+	var values []string
+	for device, p := range f {
+		values = append(values, device+":unlock="+p.Unlock+",lock="+p.Lock)
+	}
+	return strings.Join(values, " ")
+}
+
+func (f devicePolicyFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected SERIAL_OR_CODENAME:unlock=POLICY,lock=POLICY, got %q", value)
+	}
+	p := f[parts[0]]
+	for _, setting := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid policy setting %q", setting)
+		}
+		switch kv[0] {
+		case "unlock":
+			p.Unlock = kv[1]
+		case "lock":
+			p.Lock = kv[1]
+		default:
+			return fmt.Errorf("unknown policy %q, expected unlock or lock", kv[0])
+		}
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	f[parts[0]] = p
+	return nil
+}
+
+func (p policy) validate() error {
+	switch p.Unlock {
+	case "", UNLOCK_AUTO, UNLOCK_SKIP, UNLOCK_REQUIRE:
+	default:
+		return fmt.Errorf("invalid unlock policy %q, expected auto, skip or require", p.Unlock)
+	}
+	switch p.Lock {
+	case "", LOCK_ALWAYS, LOCK_NEVER, LOCK_ASK:
+	default:
+		return fmt.Errorf("invalid lock policy %q, expected always, never or ask", p.Lock)
+	}
+	return nil
+}
+
+// getPolicy returns the policy for a device, with settings for its serial
+// number taking precedence over those for its codename and the -unlock and
+// -lock flags.
+func getPolicy(serialNumber, device string) policy {
+	p := policy{Unlock: *unlockPolicyFlag, Lock: *lockPolicyFlag}
+	for _, key := range []string{device, serialNumber} {
+		if override, ok := devicePolicies[key]; ok {
+			if override.Unlock != "" {
+				p.Unlock = override.Unlock
+			}
+			if override.Lock != "" {
+				p.Lock = override.Lock
+			}
+		}
+	}
+	return p
+}
+
+// confirmLock asks the operator whether to lock a device's bootloader
+func confirmLock(serialNumber, device string) bool {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+	answer := console.prompt(serialNumber, "Lock "+device+" "+serialNumber+" bootloader? [y/N] ")
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
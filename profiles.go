@@ -0,0 +1,143 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const DEVICE_PROFILES_FILE = "devices.json"
+
+// Built-in device profiles, keyed by the codename used in factory image names.
+// Used unless a devices.json is found next to the flasher or passed with
+// -device-profiles. Devices without a profile get the defaults.
+const DEVICE_PROFILES = `{
+  "jasmine_sprout": {
+    "aliases": ["jasmine"],
+    "platform_tools": {"max": "29.0.6"},
+    "manual_fastboot": true,
+    "vendor_ids": ["18d1", "2717"]
+  },
+  "walleye": {"manual_fastboot": true, "unlock_critical": true, "vendor_ids": ["18d1"]},
+  "taimen": {"unlock_critical": true, "vendor_ids": ["18d1"]},
+  "blueline": {"vendor_ids": ["18d1"]},
+  "crosshatch": {"vendor_ids": ["18d1"]},
+  "sargo": {"vendor_ids": ["18d1"]},
+  "bonito": {"vendor_ids": ["18d1"]},
+  "flame": {"vendor_ids": ["18d1"]},
+  "coral": {"vendor_ids": ["18d1"]},
+  "sunfish": {"vendor_ids": ["18d1"]},
+  "bramble": {"vendor_ids": ["18d1"]},
+  "redfin": {"vendor_ids": ["18d1"]}
+}`
+
+const (
+	UNLOCK_FLASHING = "flashing"
+	UNLOCK_OEM      = "oem"
+
+	DEFAULT_VENDOR_ID    = "18d1"
+	DEFAULT_INSTRUCTIONS = "press volume down + power to boot it into fastboot mode"
+)
+
+var deviceProfilesFlag = flag.String("device-profiles", "", "JSON file describing per-device quirks (default: built-in, or "+DEVICE_PROFILES_FILE+" next to the flasher)")
+
+var deviceProfiles map[string]*deviceProfile
+
+type deviceProfile struct {
+	Codename string `json:"-"`
+	// Other names the device reports as product or ro.product.device
+	Aliases       []string                `json:"aliases,omitempty"`
+	PlatformTools platformToolsConstraint `json:"platform_tools"`
+	// Whether the device boots Android after an unlock or lock and has to be
+	// put back into fastboot mode by hand
+	ManualFastboot bool `json:"manual_fastboot,omitempty"`
+	// Command used to unlock and lock the bootloader, "flashing" or "oem"
+	Unlock string `json:"unlock,omitempty"`
+	// Whether critical partitions such as the bootloader and radio have to be
+	// unlocked separately with flashing unlock_critical before flashing
+	UnlockCritical bool     `json:"unlock_critical,omitempty"`
+	VendorIDs      []string `json:"vendor_ids,omitempty"`
+	// How to boot the device into fastboot mode
+	Instructions string `json:"instructions,omitempty"`
+}
+
+func loadDeviceProfiles() error {
+	data := []byte(DEVICE_PROFILES)
+	source := "built-in"
+	file := *deviceProfilesFlag
+	if file == "" {
+		if _, err := os.Stat(filepath.Join(cwd, DEVICE_PROFILES_FILE)); err == nil {
+			file = filepath.Join(cwd, DEVICE_PROFILES_FILE)
+		}
+	}
+	if file != "" {
+		fmt.Println("Using device profiles " + file)
+		source = file
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	profiles := map[string]*deviceProfile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("invalid %s device profiles: %v", source, err)
+	}
+	for codename, profile := range profiles {
+		profile.Codename = codename
+		switch profile.Unlock {
+		case "":
+			profile.Unlock = UNLOCK_FLASHING
+		case UNLOCK_FLASHING, UNLOCK_OEM:
+		default:
+			return fmt.Errorf("invalid %s device profiles: unknown unlock command %q for %s", source, profile.Unlock, codename)
+		}
+		if len(profile.VendorIDs) == 0 {
+			profile.VendorIDs = []string{DEFAULT_VENDOR_ID}
+		}
+		if profile.Instructions == "" {
+			profile.Instructions = DEFAULT_INSTRUCTIONS
+		}
+	}
+	deviceProfiles = profiles
+	return nil
+}
+
+// getProfile returns the profile for a codename or any of its aliases, or the
+// defaults for devices without a profile.
+func getProfile(device string) *deviceProfile {
+	if profile, ok := deviceProfiles[device]; ok {
+		return profile
+	}
+	for _, profile := range deviceProfiles {
+		for _, alias := range profile.Aliases {
+			if alias == device {
+				return profile
+			}
+		}
+	}
+	return &deviceProfile{
+		Codename:     device,
+		Unlock:       UNLOCK_FLASHING,
+		VendorIDs:    []string{DEFAULT_VENDOR_ID},
+		Instructions: DEFAULT_INSTRUCTIONS,
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Redraw interval when progress can be rewritten in place
+	PROGRESS_TTY_INTERVAL = 200 * time.Millisecond
+	// Interval between progress lines in logs and in parallel mode
+	PROGRESS_LOG_INTERVAL = 5 * time.Second
+)
+
+// WriteCounter reports the progress of a transfer as it is written to.
+// Size is the expected total in bytes, or 0 if unknown. Total may start
+// non-zero when resuming, only bytes written afterwards count towards speed.
+type WriteCounter struct {
+	Total uint64
+	Size  uint64
+
+	start     time.Time
+	resumed   uint64
+	lastPrint time.Time
+	inPlace   bool
+	width     int
+}
+
+func NewWriteCounter(offset, size uint64) *WriteCounter {
+	wc := &WriteCounter{Total: offset, Size: size}
+	wc.start = time.Now()
+	wc.resumed = offset
+	// Parallel output is shared with other devices, so never redraw in place there
+	wc.inPlace = isTerminal(os.Stdout) && !PARALLEL
+	return wc
+}
+
+func (wc *WriteCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	wc.Total += uint64(n)
+	interval := PROGRESS_LOG_INTERVAL
+	if wc.inPlace {
+		interval = PROGRESS_TTY_INTERVAL
+	}
+	if now := time.Now(); now.Sub(wc.lastPrint) >= interval {
+		wc.lastPrint = now
+		wc.PrintProgress()
+	}
+	return n, nil
+}
+
+// Finish prints the final state of the transfer and ends the progress line
+func (wc *WriteCounter) Finish() {
+	wc.PrintProgress()
+	if wc.inPlace {
+		fmt.Println()
+	}
+}
+
+func (wc *WriteCounter) PrintProgress() {
+	line := "Downloading... " + wc.status()
+	if !wc.inPlace {
+		fmt.Println(line)
+		return
+	}
+	// Pad to overwrite whatever was left over from a longer previous line
+	padding := ""
+	if len(line) < wc.width {
+		padding = strings.Repeat(" ", wc.width-len(line))
+	}
+	wc.width = len(line)
+	fmt.Print("\r" + line + padding)
+}
+
+func (wc *WriteCounter) status() string {
+	elapsed := time.Since(wc.start)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(wc.Total-wc.resumed) / elapsed.Seconds()
+	}
+	if wc.Size == 0 {
+		return fmt.Sprintf("%s downloaded, %s/s", Bytes(wc.Total), Bytes(uint64(rate)))
+	}
+	percent := float64(wc.Total) / float64(wc.Size) * 100
+	eta := "unknown"
+	if rate > 0 && wc.Total <= wc.Size {
+		eta = (time.Duration(float64(wc.Size-wc.Total)/rate) * time.Second).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s / %s (%.0f%%), %s/s, ETA %s", Bytes(wc.Total), Bytes(wc.Size), percent, Bytes(uint64(rate)), eta)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func logn(n, b float64) float64 {
+	return math.Log(n) / math.Log(b)
+}
+
+func humanateBytes(s uint64, base float64, sizes []string) string {
+	if s < 10 {
+		return fmt.Sprintf("%d B", s)
+	}
+	e := math.Floor(logn(float64(s), base))
+	suffix := sizes[int(e)]
+	val := math.Floor(float64(s)/math.Pow(base, e)*10+0.5) / 10
+	f := "%.0f %s"
+	if val < 10 {
+		f = "%.1f %s"
+	}
+
+	return fmt.Sprintf(f, val, suffix)
+}
+
+func Bytes(s uint64) string {
+	sizes := []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+	return humanateBytes(s, 1000, sizes)
+}
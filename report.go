@@ -0,0 +1,238 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Steps of flashDevice, in order
+const (
+	STEP_REBOOT_BOOTLOADER = "reboot to bootloader"
+	STEP_UNLOCK            = "unlock"
+	STEP_FLASH_QUEUED      = "waiting to flash"
+	STEP_FLASH             = "flash"
+	STEP_VERIFY            = "verify"
+	STEP_LOCK              = "lock"
+	STEP_REBOOT            = "reboot"
+	STEP_BOOT              = "boot"
+)
+
+var steps = []string{STEP_REBOOT_BOOTLOADER, STEP_UNLOCK, STEP_FLASH_QUEUED, STEP_FLASH, STEP_VERIFY, STEP_LOCK, STEP_REBOOT, STEP_BOOT}
+
+const (
+	STATUS_READY    = "ready"
+	STATUS_FLASHING = "flashing"
+	STATUS_FLASHED  = "flashed"
+	STATUS_FAILED   = "failed"
+	STATUS_ABORTED  = "aborted"
+	STATUS_SKIPPED  = "skipped"
+	// Stopped by Ctrl-C or SIGTERM, at the step recorded
+	STATUS_INTERRUPTED = "interrupted"
+)
+
+var reportFlag = flag.String("report", "flasher-report.json", "File to write the run report to")
+
+var report = &runReport{results: map[string]*deviceResult{}}
+
+type deviceResult struct {
+	SerialNumber string `json:"serial_number"`
+	Device       string `json:"device"`
+	Status       string `json:"status"`
+	// The current step, or the last one reached
+	Step     string    `json:"step"`
+	Error    string    `json:"error,omitempty"`
+	Locked   bool      `json:"locked"`
+	Boot     string    `json:"boot,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// The kind of failure, e.g. disconnect or remote
+	Failure string `json:"failure,omitempty"`
+	// How many times a failed step was retried
+	Retries int `json:"retries"`
+}
+
+type runReport struct {
+	sync.Mutex
+	results map[string]*deviceResult
+}
+
+func (r *runReport) add(serialNumber, device string) {
+	r.Lock()
+	defer r.Unlock()
+	r.results[serialNumber] = &deviceResult{
+		SerialNumber: serialNumber,
+		Device:       device,
+		Status:       STATUS_READY,
+	}
+}
+
+func (r *runReport) start(serialNumber, device string) {
+	r.Lock()
+	defer r.Unlock()
+	r.results[serialNumber] = &deviceResult{
+		SerialNumber: serialNumber,
+		Device:       device,
+		Status:       STATUS_FLASHING,
+		Started:      time.Now(),
+	}
+}
+
+func (r *runReport) update(serialNumber string, f func(result *deviceResult)) {
+	r.Lock()
+	defer r.Unlock()
+	if result, ok := r.results[serialNumber]; ok {
+		f(result)
+	}
+}
+
+func (r *runReport) step(serialNumber, step string) {
+	r.update(serialNumber, func(result *deviceResult) {
+		result.Step = step
+	})
+}
+
+func (r *runReport) locked(serialNumber string, locked bool) {
+	r.update(serialNumber, func(result *deviceResult) {
+		result.Locked = locked
+	})
+}
+
+func (r *runReport) retried(serialNumber string) {
+	r.update(serialNumber, func(result *deviceResult) {
+		result.Retries++
+	})
+}
+
+func (r *runReport) booted(serialNumber, boot string) {
+	r.update(serialNumber, func(result *deviceResult) {
+		result.Boot = boot
+	})
+}
+
+func (r *runReport) finish(serialNumber string, err error) {
+	r.update(serialNumber, func(result *deviceResult) {
+		result.Finished = time.Now()
+		if err != nil && interrupted() && (errors.Is(err, errInterrupted) || errors.Is(err, context.Canceled)) {
+			result.Status = STATUS_INTERRUPTED
+			result.Error = err.Error()
+		} else if errors.Is(err, context.Canceled) {
+			result.Status = STATUS_ABORTED
+			result.Error = err.Error()
+		} else if err != nil {
+			result.Status = STATUS_FAILED
+			result.Error = err.Error()
+			result.Failure = classifyFailure(err)
+		} else {
+			result.Status = STATUS_FLASHED
+		}
+	})
+}
+
+func (r *runReport) skip(serialNumber string) {
+	r.update(serialNumber, func(result *deviceResult) {
+		result.Status = STATUS_SKIPPED
+	})
+}
+
+// progress estimates how far along a device is, from 0 to 1
+func (result deviceResult) progress() float64 {
+	switch result.Status {
+	case STATUS_FLASHED:
+		return 1
+	case STATUS_READY, STATUS_SKIPPED:
+		return 0
+	}
+	for i, step := range steps {
+		if step == result.Step {
+			return float64(i) / float64(len(steps))
+		}
+	}
+	return 0
+}
+
+// elapsed is how long a device has been or was being flashed
+func (result deviceResult) elapsed() time.Duration {
+	switch {
+	case result.Started.IsZero():
+		return 0
+	case result.Finished.IsZero():
+		return time.Since(result.Started)
+	default:
+		return result.Finished.Sub(result.Started)
+	}
+}
+
+// snapshot returns a copy of every result, ordered by serial number
+func (r *runReport) snapshot() []deviceResult {
+	r.Lock()
+	defer r.Unlock()
+	results := make([]deviceResult, 0, len(r.results))
+	for _, result := range r.results {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].SerialNumber < results[j].SerialNumber
+	})
+	return results
+}
+
+func (r *runReport) print() {
+	fmt.Println()
+	fmt.Println("Summary:")
+	for _, result := range r.snapshot() {
+		line := result.Device + " " + result.SerialNumber + ": " + result.Status
+		if result.Error != "" {
+			line += " during " + result.Step + " (" + result.Error + ")"
+		} else if result.Status == STATUS_FLASHED && !result.Locked {
+			// The lock policy left it unlocked
+			line += ", bootloader unlocked"
+		}
+		if result.Boot != "" {
+			line += ", " + result.Boot
+		}
+		if result.Retries > 0 {
+			line += fmt.Sprintf(" after %d retries", result.Retries)
+		}
+		if result.Status == STATUS_FAILED || result.Status == STATUS_ABORTED || result.Status == STATUS_INTERRUPTED {
+			fmt.Println(Error(line))
+		} else {
+			fmt.Println(line)
+		}
+	}
+}
+
+func (r *runReport) save(file string) error {
+	if file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(struct {
+		Version string         `json:"version"`
+		Devices []deviceResult `json:"devices"`
+	}{version, r.snapshot()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
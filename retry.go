@@ -0,0 +1,164 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Kinds of step failures
+const (
+	// The device dropped off USB or never came back
+	FAILURE_DISCONNECT = "disconnect"
+	// The bootloader refused a command, e.g. FAILED (remote: 'Flashing is not allowed')
+	FAILURE_REMOTE  = "remote"
+	FAILURE_TIMEOUT = "timeout"
+	// Transferring data to the device failed
+	FAILURE_WRITE = "write"
+	FAILURE_OTHER = "other"
+)
+
+// Output tail kept from commands to classify their failures
+const FAILURE_OUTPUT_SIZE = 4096
+
+var (
+	retriesFlag = flag.Int("retries", 2, "How many times to retry a failed step once the device is back")
+	retryOnFlag = flag.String("retry-on", FAILURE_DISCONNECT+","+FAILURE_TIMEOUT+","+FAILURE_WRITE, "Comma-separated kinds of failures to retry: disconnect, remote, timeout, write and other")
+)
+
+// Output patterns of each kind of failure, checked in order
+var failurePatterns = []struct {
+	kind     string
+	patterns []string
+}{
+	{FAILURE_REMOTE, []string{"FAILED (remote"}},
+	{FAILURE_WRITE, []string{"Write to device failed", "failed to write", "data transfer failure", "LIBUSB_ERROR_PIPE", "LIBUSB_ERROR_IO", "Broken pipe"}},
+	{FAILURE_DISCONNECT, []string{"no such device", "device not found", "no devices", "LIBUSB_ERROR_NO_DEVICE", "did not show up", "protocol fault", "Connection reset"}},
+}
+
+// stepError is a failed command along with the end of its output
+type stepError struct {
+	err    error
+	output string
+}
+
+func (e *stepError) Error() string {
+	lines := strings.Split(strings.TrimSpace(e.output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return e.err.Error() + ": " + last
+	}
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// classifyFailure tells what kind of failure err is
+func classifyFailure(err error) string {
+	text := err.Error()
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
+		text += "\n" + stepErr.output
+	}
+	for _, failure := range failurePatterns {
+		for _, pattern := range failure.patterns {
+			if strings.Contains(strings.ToLower(text), strings.ToLower(pattern)) {
+				return failure.kind
+			}
+		}
+	}
+	if isTimeout(err) {
+		return FAILURE_TIMEOUT
+	}
+	return FAILURE_OTHER
+}
+
+func validateRetryPolicy() error {
+	if *retriesFlag < 0 {
+		return fmt.Errorf("invalid -retries %d", *retriesFlag)
+	}
+	for _, kind := range strings.Split(*retryOnFlag, ",") {
+		switch strings.TrimSpace(kind) {
+		case "", FAILURE_DISCONNECT, FAILURE_REMOTE, FAILURE_TIMEOUT, FAILURE_WRITE, FAILURE_OTHER:
+		default:
+			return fmt.Errorf("invalid -retry-on failure kind %q, expected disconnect, remote, timeout, write or other", kind)
+		}
+	}
+	return nil
+}
+
+func retryable(kind string) bool {
+	for _, retryOn := range strings.Split(*retryOnFlag, ",") {
+		if strings.TrimSpace(retryOn) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// retryStep runs a step, and runs it again after the device re-enumerates in
+// fastboot mode when it fails in a way the retry policy allows
+func retryStep(ctx context.Context, serialNumber, device string, step func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil || ctx.Err() != nil || interrupted() {
+			return err
+		}
+		kind := classifyFailure(err)
+		if !retryable(kind) || attempt > *retriesFlag {
+			return err
+		}
+		report.retried(serialNumber)
+		deviceWarnln(serialNumber, fmt.Sprintf("%s %s %s failure: %v", device, serialNumber, kind, err))
+		deviceWarnln(serialNumber, fmt.Sprintf("Retrying once %s %s is back in fastboot mode (retry %d of %d)", device, serialNumber, attempt, *retriesFlag))
+		if adbDeviceState(serialNumber) == "device" {
+			platformToolCommand := *adb
+			platformToolCommand.Args = append(platformToolCommand.Args, "-s", serialNumber, "reboot", "bootloader")
+			_ = runCommand(ctx, COMMAND_TIMEOUT, &platformToolCommand)
+		}
+		if err := waitForFastboot(ctx, serialNumber, REBOOT_TIMEOUT); err != nil {
+			return err
+		}
+	}
+}
+
+// tailBuffer keeps the end of what is written to it
+type tailBuffer struct {
+	sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > FAILURE_OUTPUT_SIZE {
+		t.buf = t.buf[len(t.buf)-FAILURE_OUTPUT_SIZE:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.Lock()
+	defer t.Unlock()
+	return string(t.buf)
+}
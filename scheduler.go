@@ -0,0 +1,77 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	maxFlashingFlag = flag.Int("max-flashing", 0, "Maximum number of devices transferring images at the same time, 0 for no limit. Other steps, such as waiting for unlock confirmation, are never limited")
+	staggerFlag     = flag.Duration("stagger", 0, "Minimum delay between the start of image transfers to different devices, e.g. 20s")
+)
+
+var flashLimiter = &limiter{}
+
+// limiter bounds and spaces out heavy steps, i.e. flash-all runs, which
+// saturate USB and disk I/O when too many devices run them at once.
+type limiter struct {
+	once  sync.Once
+	slots chan struct{}
+
+	sync.Mutex
+	next time.Time
+}
+
+// acquire waits for a free slot and the end of the stagger delay. On error,
+// i.e. when ctx is done first, there is nothing to release.
+func (l *limiter) acquire(ctx context.Context) error {
+	l.once.Do(func() {
+		if *maxFlashingFlag > 0 {
+			l.slots = make(chan struct{}, *maxFlashingFlag)
+		}
+	})
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if *staggerFlag > 0 {
+		l.Lock()
+		wait := time.Until(l.next)
+		if wait < 0 {
+			wait = 0
+		}
+		l.next = time.Now().Add(wait + *staggerFlag)
+		l.Unlock()
+		if err := sleep(ctx, wait); err != nil {
+			l.release()
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	serialsFlag     = flag.String("serials", "", "Comma-separated serial numbers of the only devices to flash")
+	serialsFileFlag = flag.String("serials-file", "", "File listing the serial numbers of the only devices to flash, one per line")
+	excludeFlag     = flag.String("exclude", "", "Comma-separated serial numbers of devices never to flash")
+	excludeFileFlag = flag.String("exclude-file", "", "File listing the serial numbers of devices never to flash, one per line")
+	selectFlag      = flag.Bool("select", false, "Choose which of the detected devices to flash")
+)
+
+// serialList reads serial numbers from a comma-separated flag and a file with
+// one per line, where # starts a comment
+func serialList(list, file string) (map[string]bool, error) {
+	serials := map[string]bool{}
+	for _, serialNumber := range strings.Split(list, ",") {
+		if serialNumber = strings.TrimSpace(serialNumber); serialNumber != "" {
+			serials[serialNumber] = true
+		}
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+			if line != "" {
+				serials[line] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return serials, nil
+}
+
+// filterDevices keeps the devices allowed by -serials and -serials-file, if
+// any are given, and not excluded by -exclude or -exclude-file. With -resume,
+// only devices interrupted in the last run are kept.
+func filterDevices(devices map[string]string) (map[string]string, error) {
+	allowed, err := serialList(*serialsFlag, *serialsFileFlag)
+	if err != nil {
+		return nil, err
+	}
+	var resumed map[string]bool
+	if *resumeFlag {
+		resumed, err = interruptedDevices(*reportFlag)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume from %s: %v", *reportFlag, err)
+		}
+	}
+	excluded, err := serialList(*excludeFlag, *excludeFileFlag)
+	if err != nil {
+		return nil, err
+	}
+	filtered := map[string]string{}
+	for serialNumber, device := range devices {
+		switch {
+		case len(allowed) > 0 && !allowed[serialNumber]:
+			deviceln(serialNumber, "Skipping "+device+" "+serialNumber+", not in the list of devices to flash")
+		case excluded[serialNumber]:
+			deviceln(serialNumber, "Skipping excluded "+device+" "+serialNumber)
+		case *resumeFlag && !resumed[serialNumber]:
+			deviceln(serialNumber, "Skipping "+device+" "+serialNumber+", not interrupted in the last run")
+		default:
+			filtered[serialNumber] = device
+		}
+	}
+	return filtered, nil
+}
+
+// selectDevices filters the detected devices and lets the operator choose
+// among them with -select, or pick one when only one device can be flashed
+// at a time
+func selectDevices(detected map[string]string) (map[string]string, error) {
+	devices, err := filterDevices(detected)
+	if err != nil {
+		return nil, err
+	}
+	allowed, _ := serialList(*serialsFlag, *serialsFileFlag)
+	for serialNumber := range allowed {
+		_, ok := detected[serialNumber]
+		switch {
+		case ok:
+			// Kept, or filterDevices said why not
+		case adbDeviceState(serialNumber) != "" || fastbootDeviceConnected(serialNumber):
+			// Detected without a matching factory image
+			warnln(serialNumber + " has no matching factory image")
+		default:
+			warnln(serialNumber + " is not connected")
+		}
+	}
+	if len(devices) <= 1 || (PARALLEL && !*selectFlag) {
+		return devices, nil
+	}
+	var serialNumbers []string
+	for serialNumber := range devices {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	sort.Strings(serialNumbers)
+	fmt.Println()
+	for i, serialNumber := range serialNumbers {
+		fmt.Printf("%d. %s %s\n", i+1, devices[serialNumber], serialNumber)
+	}
+	for {
+		var chosen []int
+		if PARALLEL {
+			fmt.Print(Warn("Devices to flash, e.g. 1 3, or ENTER for all: "))
+			chosen, err = readChoices(len(serialNumbers))
+			if err == nil && len(chosen) == 0 {
+				return devices, nil
+			}
+		} else {
+			fmt.Print(Warn("Only one device can be flashed at a time. Device to flash: "))
+			chosen, err = readChoices(len(serialNumbers))
+			if err == nil && len(chosen) != 1 {
+				err = fmt.Errorf("choose one device")
+			}
+		}
+		if err == io.EOF {
+			// Nobody is left to answer, e.g. stdin is not a terminal
+			return nil, errors.New("no device chosen before the end of input")
+		}
+		if err != nil {
+			errorln(err, false)
+			continue
+		}
+		selected := map[string]string{}
+		for _, i := range chosen {
+			selected[serialNumbers[i-1]] = devices[serialNumbers[i-1]]
+		}
+		return selected, nil
+	}
+}
+
+// readChoices reads space or comma-separated numbers from 1 to n
+func readChoices(n int) ([]int, error) {
+	line, err := stdin.readLine(nil)
+	if err != nil {
+		return nil, err
+	}
+	var choices []int
+	for _, field := range strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 1 || i > n {
+			return nil, fmt.Errorf("invalid choice %q, expected a number from 1 to %d", field, n)
+		}
+		choices = append(choices, i)
+	}
+	return choices, nil
+}
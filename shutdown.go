@@ -0,0 +1,124 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Exit status after Ctrl-C or SIGTERM
+	EXIT_INTERRUPTED = 130
+	// How long steps in progress may take to finish once interrupted
+	SHUTDOWN_TIMEOUT = 2 * time.Minute
+)
+
+var (
+	shutdownTimeoutFlag = flag.Duration("shutdown-timeout", SHUTDOWN_TIMEOUT, "On Ctrl-C or SIGTERM, how long steps in progress may take to finish before they are aborted")
+	resumeFlag          = flag.Bool("resume", false, "Only flash the devices recorded as interrupted in the report of the last run, starting over")
+)
+
+var errInterrupted = errors.New("interrupted")
+
+var shutdown = struct {
+	sync.Mutex
+	requested bool
+	// The station flashing devices, if flashing has started
+	station *station
+}{}
+
+// handleSignals shuts down on Ctrl-C or SIGTERM. Before flashing, the flasher
+// cleans up and exits right away. While flashing, no device starts a new step
+// and steps in progress get -shutdown-timeout to finish, or until a second
+// signal, before they are aborted. flashDevices then returns with the step
+// each device stopped at in the report.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		shutdown.Lock()
+		shutdown.requested = true
+		st := shutdown.station
+		shutdown.Unlock()
+		if st == nil {
+			warnln("\nInterrupted, exiting...")
+			cleanup()
+			os.Exit(EXIT_INTERRUPTED)
+		}
+		console.once("interrupted", "Interrupted, waiting up to "+shutdownTimeoutFlag.String()+" for steps in progress to finish. Interrupt again to abort them now.")
+		select {
+		case <-signals:
+		case <-time.After(*shutdownTimeoutFlag):
+		}
+		st.abortAll()
+	}()
+}
+
+// watchShutdown has signals interrupt the devices of st instead of exiting
+func watchShutdown(st *station) {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+	shutdown.station = st
+}
+
+// interrupted reports whether the flasher has been asked to shut down
+func interrupted() bool {
+	shutdown.Lock()
+	defer shutdown.Unlock()
+	return shutdown.requested
+}
+
+// beginStep records that a device moves on to a step, unless the flasher is
+// shutting down
+func beginStep(serialNumber, step string) error {
+	if interrupted() {
+		return errInterrupted
+	}
+	report.step(serialNumber, step)
+	return nil
+}
+
+// interruptedDevices returns the serial numbers of the devices recorded as
+// interrupted in a report. Flashing them again starts over, as a step cut
+// short may have left a partition half written.
+func interruptedDevices(file string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var saved struct {
+		Devices []deviceResult `json:"devices"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	serials := map[string]bool{}
+	for _, result := range saved.Devices {
+		if result.Status == STATUS_INTERRUPTED {
+			serials[result.SerialNumber] = true
+		}
+	}
+	return serials, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errUnknownDevice = errors.New("unknown device")
+	errDeviceBusy    = errors.New("device is being flashed")
+	errDeviceIdle    = errors.New("device is not being flashed")
+)
+
+// station controls the devices of a flashing run, so that each of them can
+// be started, skipped, retried or aborted on its own, e.g. from the TUI.
+type station struct {
+	sync.Mutex
+	devices map[string]*stationDevice
+	wg      sync.WaitGroup
+}
+
+type stationDevice struct {
+	device string
+	// Set while the device is being flashed
+	cancel context.CancelFunc
+}
+
+func newStation() *station {
+	return &station{devices: map[string]*stationDevice{}}
+}
+
+// add makes a device known to the station, ready to be started
+func (s *station) add(serialNumber, device string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.devices[serialNumber]; ok {
+		return
+	}
+	s.devices[serialNumber] = &stationDevice{device: device}
+	report.add(serialNumber, device)
+}
+
+// known reports whether a device has been added
+func (s *station) known(serialNumber string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.devices[serialNumber]
+	return ok
+}
+
+// start flashes a device in the background. A device that failed, was
+// aborted or skipped is started over.
+func (s *station) start(serialNumber string) error {
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.devices[serialNumber]
+	if !ok {
+		return errUnknownDevice
+	}
+	if d.cancel != nil {
+		return errDeviceBusy
+	}
+	if interrupted() {
+		return errInterrupted
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	report.start(serialNumber, d.device)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		err := flashDevice(ctx, serialNumber, d.device)
+		if err != nil {
+			deviceErrorln(serialNumber, "Failed to flash "+d.device+" "+serialNumber+": "+err.Error())
+		}
+		report.finish(serialNumber, err)
+		s.Lock()
+		d.cancel = nil
+		s.Unlock()
+	}()
+	return nil
+}
+
+func (s *station) abort(serialNumber string) error {
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.devices[serialNumber]
+	if !ok {
+		return errUnknownDevice
+	}
+	if d.cancel == nil {
+		return errDeviceIdle
+	}
+	d.cancel()
+	// Don't leave it waiting for an answer
+	console.answer(serialNumber, "")
+	return nil
+}
+
+// abortAll aborts every device being flashed
+func (s *station) abortAll() {
+	s.Lock()
+	defer s.Unlock()
+	for serialNumber, d := range s.devices {
+		if d.cancel != nil {
+			d.cancel()
+			console.answer(serialNumber, "")
+		}
+	}
+}
+
+func (s *station) skip(serialNumber string) error {
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.devices[serialNumber]
+	if !ok {
+		return errUnknownDevice
+	}
+	if d.cancel != nil {
+		return errDeviceBusy
+	}
+	report.skip(serialNumber)
+	return nil
+}
+
+// busy reports whether any device is being flashed
+func (s *station) busy() bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, d := range s.devices {
+		if d.cancel != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until every started device is done
+func (s *station) wait() {
+	s.wg.Wait()
+}
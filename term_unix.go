@@ -0,0 +1,45 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// makeRaw turns off line buffering and echo on a terminal so that single key
+// presses can be read, until restore is called
+func makeRaw(f *os.File) (restore func(), err error) {
+	stty := exec.Command("stty", "-g")
+	stty.Stdin = f
+	state, err := stty.Output()
+	if err != nil {
+		return nil, err
+	}
+	stty = exec.Command("stty", "-icanon", "-echo", "min", "1")
+	stty.Stdin = f
+	if err := stty.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty := exec.Command("stty", strings.TrimSpace(string(state)))
+		stty.Stdin = f
+		_ = stty.Run()
+	}, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	UI_PLAIN = "plain"
+	UI_TUI   = "tui"
+
+	TUI_REFRESH_INTERVAL = 500 * time.Millisecond
+	PROGRESS_BAR_WIDTH   = 20
+	// Log lines shown for the selected device
+	TUI_LOG_LINES = 10
+)
+
+var uiFlag = flag.String("ui", UI_PLAIN, "User interface: plain, or tui for a full-screen view of every device with per-device controls")
+
+// runTUI shows every device of the station as a row and lets the operator
+// start, skip, retry and abort them one by one, until they quit with nothing
+// left running.
+func runTUI(st *station) error {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return errors.New("the TUI needs a terminal, use -ui plain")
+	}
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	console.setQuiet(true)
+	defer console.setQuiet(false)
+	// Switch to the alternate screen and hide the cursor
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	keys := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go readKeys(keys, done)
+	ticker := time.NewTicker(TUI_REFRESH_INTERVAL)
+	defer ticker.Stop()
+	selected := 0
+	message := ""
+	for {
+		results := report.snapshot()
+		if selected >= len(results) {
+			selected = len(results) - 1
+		}
+		drawTUI(results, selected, message)
+		if interrupted() && !st.busy() {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case key := <-keys:
+			message = ""
+			if len(results) == 0 {
+				if key == "q" {
+					return nil
+				}
+				continue
+			}
+			serialNumber := results[selected].SerialNumber
+			switch key {
+			case "up", "k":
+				if selected > 0 {
+					selected--
+				}
+			case "down", "j":
+				if selected < len(results)-1 {
+					selected++
+				}
+			case "s":
+				err = st.start(serialNumber)
+			case "S":
+				for _, result := range results {
+					if result.Status == STATUS_READY {
+						_ = st.start(result.SerialNumber)
+					}
+				}
+			case "r":
+				if status := results[selected].Status; status != STATUS_FAILED && status != STATUS_ABORTED {
+					err = errors.New("only failed or aborted devices can be retried")
+				} else {
+					err = st.start(serialNumber)
+				}
+			case "x":
+				err = st.skip(serialNumber)
+			case "a":
+				err = st.abort(serialNumber)
+			case "y", "n":
+				if !console.answer(serialNumber, key) {
+					err = errors.New("nothing to answer")
+				}
+			case "q":
+				if st.busy() {
+					err = errors.New("abort the devices being flashed before quitting")
+				} else {
+					return nil
+				}
+			}
+			if err != nil {
+				message = results[selected].Device + " " + serialNumber + ": " + err.Error()
+				err = nil
+			}
+		}
+	}
+}
+
+// readKeys sends keys pressed in raw mode, with arrow keys named up and down,
+// until done is closed
+func readKeys(keys chan<- string, done <-chan struct{}) {
+	for {
+		key, err := stdin.readKey(done)
+		if err != nil {
+			return
+		}
+		name := key
+		switch {
+		case key == "\033[A":
+			name = "up"
+		case key == "\033[B":
+			name = "down"
+		case strings.HasPrefix(key, "\033["):
+			continue
+		}
+		select {
+		case keys <- name:
+		case <-done:
+			// Leave it for whoever reads next
+			stdin.unread([]byte(key))
+			return
+		}
+	}
+}
+
+func drawTUI(results []deviceResult, selected int, message string) {
+	var b strings.Builder
+	// Redraw from the top left
+	b.WriteString("\033[H\033[2J")
+	b.WriteString(Blue("Android Factory Image Flasher version "+version) + "\r\n\r\n")
+	b.WriteString(fmt.Sprintf("  %-16s %-20s %-10s %-22s %-*s %8s  %s\r\n", "DEVICE", "SERIAL", "STATUS", "STEP", PROGRESS_BAR_WIDTH+2, "PROGRESS", "ELAPSED", "LAST ERROR"))
+	for i, result := range results {
+		cursor := "  "
+		if i == selected {
+			cursor = "> "
+		}
+		row := fmt.Sprintf("%-16s %-20s %-10s %-22s %s %8v  %s", result.Device, result.SerialNumber, result.Status, result.Step, progressBar(result.progress()), result.elapsed().Round(time.Second), result.Error)
+		switch result.Status {
+		case STATUS_FAILED, STATUS_ABORTED, STATUS_INTERRUPTED:
+			row = Error(row)
+		case STATUS_FLASHED:
+			row = Green(row)
+		}
+		b.WriteString(cursor + row + "\r\n")
+	}
+	b.WriteString("\r\n")
+	for _, notice := range console.getNotices() {
+		b.WriteString(Warn(notice) + "\r\n")
+	}
+	if len(results) > 0 {
+		result := results[selected]
+		b.WriteString("\r\n" + Cyan(result.Device+" "+result.SerialNumber) + "\r\n")
+		log := console.log(result.SerialNumber)
+		if len(log) > TUI_LOG_LINES {
+			log = log[len(log)-TUI_LOG_LINES:]
+		}
+		for _, line := range log {
+			b.WriteString("  " + line + "\r\n")
+		}
+		if question := console.pending(result.SerialNumber); question != "" {
+			b.WriteString(Warn(question+"(y/n)") + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	if message != "" {
+		b.WriteString(Error(message) + "\r\n")
+	}
+	b.WriteString("↑/↓ select  s start  S start all  x skip  r retry  a abort  y/n answer  q quit\r\n")
+	fmt.Print(b.String())
+}
+
+func progressBar(progress float64) string {
+	filled := int(progress * PROGRESS_BAR_WIDTH)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled) + "]"
+}
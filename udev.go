@@ -0,0 +1,256 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strings"
+)
+
+const (
+	// systemd-logind only applies TAG+="uaccess" from rules that run before
+	// 73-seat-late.rules
+	RULES_FILE = "70-device-flasher.rules"
+	// Installed by earlier versions, too late for uaccess to apply
+	LEGACY_RULES_FILE = "98-device-flasher.rules"
+	RULES_PATH        = "/etc/udev/rules.d/"
+	// Group conventionally granted access to USB devices on Debian and derivatives
+	USB_GROUP = "plugdev"
+)
+
+// Names of the USB vendor IDs of supported devices, for rule comments
+var usbVendors = map[string]string{
+	"18d1": "Google",
+	"2717": "Xiaomi",
+}
+
+// udevVendorIDs returns the USB vendor IDs of every device profile
+func udevVendorIDs() []string {
+	seen := map[string]bool{DEFAULT_VENDOR_ID: true}
+	for _, profile := range deviceProfiles {
+		for _, vendorID := range profile.VendorIDs {
+			seen[strings.ToLower(vendorID)] = true
+		}
+	}
+	var vendorIDs []string
+	for vendorID := range seen {
+		vendorIDs = append(vendorIDs, vendorID)
+	}
+	sort.Strings(vendorIDs)
+	return vendorIDs
+}
+
+// generateUdevRules grants access to devices of the given vendors to the user
+// logged in at the seat (uaccess), e.g. in a desktop session, and to members
+// of group, e.g. over SSH, if there is such a group.
+func generateUdevRules(vendorIDs []string, group string) string {
+	var b strings.Builder
+	b.WriteString("# Installed by device-flasher udev install\n")
+	for _, vendorID := range vendorIDs {
+		if name, ok := usbVendors[vendorID]; ok {
+			b.WriteString("# " + name + "\n")
+		}
+		rule := "SUBSYSTEM==\"usb\", ATTR{idVendor}==\"" + vendorID + "\", MODE=\"0660\", TAG+=\"uaccess\""
+		if group != "" {
+			rule += ", GROUP=\"" + group + "\""
+		}
+		b.WriteString(rule + "\n")
+	}
+	return b.String()
+}
+
+// udevGroup returns USB_GROUP if it exists on this machine
+func udevGroup() string {
+	if _, err := user.LookupGroup(USB_GROUP); err != nil {
+		return ""
+	}
+	return USB_GROUP
+}
+
+func udevRules() string {
+	return generateUdevRules(udevVendorIDs(), udevGroup())
+}
+
+// udevCommand runs udev install, uninstall or status and returns the exit status
+func udevCommand(args []string) int {
+	if OS != "linux" {
+		fmt.Println("udev rules are only needed on Linux")
+		return 0
+	}
+	if len(args) != 1 {
+		errorln("Usage: udev install|uninstall|status", false)
+		return 2
+	}
+	if err := loadDeviceProfiles(); err != nil {
+		errorln(err, false)
+		return 1
+	}
+	switch args[0] {
+	case "install":
+		if err := installUdevRules(); err != nil {
+			errorln("Cannot install udev rules: "+err.Error(), false)
+			return 1
+		}
+		fmt.Println("Installed " + RULES_PATH + RULES_FILE + ". Reconnect your devices.")
+	case "uninstall":
+		if err := uninstallUdevRules(); err != nil {
+			errorln("Cannot uninstall udev rules: "+err.Error(), false)
+			return 1
+		}
+		fmt.Println("Removed " + RULES_PATH + RULES_FILE)
+	case "status":
+		if !udevStatus() {
+			return 1
+		}
+	default:
+		errorln("Usage: udev install|uninstall|status", false)
+		return 2
+	}
+	return 0
+}
+
+func installUdevRules() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("must be run as root, e.g. sudo %s udev install", os.Args[0])
+	}
+	if err := os.MkdirAll(RULES_PATH, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(RULES_PATH+RULES_FILE, []byte(udevRules()), 0644); err != nil {
+		return err
+	}
+	if err := os.Remove(RULES_PATH + LEGACY_RULES_FILE); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return reloadUdevRules()
+}
+
+func uninstallUdevRules() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("must be run as root, e.g. sudo %s udev uninstall", os.Args[0])
+	}
+	for _, file := range []string{RULES_FILE, LEGACY_RULES_FILE} {
+		if err := os.Remove(RULES_PATH + file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return reloadUdevRules()
+}
+
+func reloadUdevRules() error {
+	if out, err := exec.Command("udevadm", "control", "--reload-rules").CombinedOutput(); err != nil {
+		return fmt.Errorf("udevadm control --reload-rules: %v: %s", err, bytes.TrimSpace(out))
+	}
+	if out, err := exec.Command("udevadm", "trigger", "--subsystem-match=usb").CombinedOutput(); err != nil {
+		return fmt.Errorf("udevadm trigger: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// udevStatus prints whether the rules are installed and up to date, and
+// whether the connected devices are accessible, and returns true if
+// everything is in order.
+func udevStatus() bool {
+	ok := true
+	installed, err := ioutil.ReadFile(RULES_PATH + RULES_FILE)
+	switch {
+	case os.IsNotExist(err):
+		warnln(RULES_PATH + RULES_FILE + " is not installed")
+		ok = false
+	case err != nil:
+		errorln(err, false)
+		ok = false
+	case string(installed) != udevRules():
+		warnln(RULES_PATH + RULES_FILE + " is out of date with the supported devices")
+		ok = false
+	default:
+		fmt.Println(RULES_PATH + RULES_FILE + " is installed and up to date")
+	}
+	if _, err := os.Stat(RULES_PATH + LEGACY_RULES_FILE); err == nil {
+		warnln(RULES_PATH + LEGACY_RULES_FILE + " is from an earlier version and runs too late for uaccess")
+		ok = false
+	}
+	if group := udevGroup(); group != "" && !inGroup(group) {
+		warnln("You are not a member of the " + group + " group, devices are only accessible from a local desktop session")
+	}
+	devices, err := findUSBDevices(SYSFS_USB_DEVICES, udevVendorIDs())
+	if err != nil {
+		errorln(err, false)
+		return false
+	}
+	for _, d := range devices {
+		if usbAccessible(d.node(DEV_BUS_USB)) {
+			fmt.Println(d.Product + " " + d.SerialNumber + " is accessible")
+		} else {
+			warnln(d.Product + " " + d.SerialNumber + " is not accessible at " + d.node(DEV_BUS_USB))
+			ok = false
+		}
+	}
+	if !ok {
+		fmt.Println("Run: sudo " + os.Args[0] + " udev install")
+	}
+	return ok
+}
+
+// hasUSBAccess reports whether the current user can use every connected
+// supported device, so that no udev rules are needed
+func hasUSBAccess() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	devices, err := findUSBDevices(SYSFS_USB_DEVICES, udevVendorIDs())
+	if err != nil {
+		return false
+	}
+	for _, d := range devices {
+		if !usbAccessible(d.node(DEV_BUS_USB)) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUdevRules warns before flashing if devices may not be accessible,
+// rather than installing rules behind the user's back
+func checkUdevRules() {
+	if hasUSBAccess() {
+		return
+	}
+	warnln("Some connected devices are not accessible by the current user.")
+	warnln("To fix this, run: sudo " + os.Args[0] + " udev install")
+}
+
+func inGroup(name string) bool {
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return false
+	}
+	current, err := user.Current()
+	if err != nil {
+		return false
+	}
+	ids, err := current.GroupIds()
+	if err != nil {
+		return false
+	}
+	return contains(ids, group.Gid)
+}
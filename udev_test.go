@@ -0,0 +1,45 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// systemd-logind applies uaccess tags in 73-seat-late.rules, so rules adding
+// them have to be loaded first. udev loads rules files in lexical order.
+func TestUdevRulesFileOrder(t *testing.T) {
+	if RULES_FILE >= "73-seat-late.rules" {
+		t.Errorf("%s is loaded after 73-seat-late.rules, its uaccess tags would be ignored", RULES_FILE)
+	}
+}
+
+func TestGenerateUdevRules(t *testing.T) {
+	rules := generateUdevRules([]string{"18d1", "2a70"}, "")
+	for _, want := range []string{
+		"# Google\n",
+		`SUBSYSTEM=="usb", ATTR{idVendor}=="18d1", MODE="0660", TAG+="uaccess"` + "\n",
+		`SUBSYSTEM=="usb", ATTR{idVendor}=="2a70", MODE="0660", TAG+="uaccess"` + "\n",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules %q do not contain %q", rules, want)
+		}
+	}
+	if rules := generateUdevRules([]string{"18d1"}, USB_GROUP); !strings.Contains(rules, `TAG+="uaccess", GROUP="plugdev"`) {
+		t.Errorf("rules %q do not grant access to the plugdev group", rules)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	SYSFS_USB_DEVICES = "/sys/bus/usb/devices"
+	DEV_BUS_USB       = "/dev/bus/usb"
+)
+
+// usbDevice is a USB device as described by Linux sysfs
+type usbDevice struct {
+	// e.g. 1-2
+	Name         string
+	VendorID     string
+	ProductID    string
+	SerialNumber string
+	Product      string
+	Bus          int
+	Device       int
+}
+
+// node returns the device node of a USB device under devRoot, i.e. /dev/bus/usb
+func (d usbDevice) node(devRoot string) string {
+	return filepath.Join(devRoot, fmt.Sprintf("%03d", d.Bus), fmt.Sprintf("%03d", d.Device))
+}
+
+// findUSBDevices lists the USB devices under sysfsRoot, i.e.
+// /sys/bus/usb/devices, made by any of vendorIDs
+func findUSBDevices(sysfsRoot string, vendorIDs []string) ([]usbDevice, error) {
+	entries, err := ioutil.ReadDir(sysfsRoot)
+	if err != nil {
+		return nil, err
+	}
+	var devices []usbDevice
+	for _, entry := range entries {
+		// Interfaces, e.g. 1-2:1.0, and root hubs, e.g. usb1, describe no device
+		if strings.Contains(entry.Name(), ":") || strings.HasPrefix(entry.Name(), "usb") {
+			continue
+		}
+		dir := filepath.Join(sysfsRoot, entry.Name())
+		d := usbDevice{
+			Name:         entry.Name(),
+			VendorID:     readSysfs(dir, "idVendor"),
+			ProductID:    readSysfs(dir, "idProduct"),
+			SerialNumber: readSysfs(dir, "serial"),
+			Product:      readSysfs(dir, "product"),
+		}
+		if !contains(vendorIDs, d.VendorID) {
+			continue
+		}
+		d.Bus, _ = strconv.Atoi(readSysfs(dir, "busnum"))
+		d.Device, _ = strconv.Atoi(readSysfs(dir, "devnum"))
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// usbAccessible reports whether the current user can open a USB device node
+// the way adb and fastboot do
+func usbAccessible(node string) bool {
+	f, err := os.OpenFile(node, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func readSysfs(dir, attribute string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
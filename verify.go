@@ -0,0 +1,142 @@
+// Copyright 2020 CIS Maxwell, LLC. All rights reserved.
+// Copyright 2020 The Calyx Institute
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// factoryMetadata describes the build contained in a factory image. Fields
+// the image does not specify are left empty and not verified.
+type factoryMetadata struct {
+	Device     string
+	Bootloader string
+	Baseband   string
+	BuildID    string
+}
+
+// readFactoryMetadata reads the expected bootloader and baseband versions from
+// android-info.txt in the image zip of an extracted factory image, and the
+// build ID from the image zip name, e.g. image-walleye-rp1a.201005.004.zip.
+func readFactoryMetadata(folder string) (*factoryMetadata, error) {
+	images, err := filepath.Glob(filepath.Join(folder, "image-*.zip"))
+	if err != nil {
+		return nil, err
+	}
+	if len(images) != 1 {
+		return nil, fmt.Errorf("expected one image zip in %s, found %d", folder, len(images))
+	}
+	name := strings.TrimSuffix(filepath.Base(images[0]), ".zip")
+	parts := strings.Split(name, "-")
+	metadata := &factoryMetadata{}
+	if len(parts) >= 3 {
+		metadata.Device = parts[1]
+		metadata.BuildID = parts[len(parts)-1]
+	}
+
+	r, err := zip.OpenReader(images[0])
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != "android-info.txt" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		scanner := bufio.NewScanner(rc)
+		for scanner.Scan() {
+			// e.g. require version-bootloader=mw8998-003.2010.01|mw8998-003.2011.01
+			line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "require ")
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "version-bootloader":
+				metadata.Bootloader = kv[1]
+			case "version-baseband":
+				metadata.Baseband = kv[1]
+			}
+		}
+		return metadata, scanner.Err()
+	}
+	return metadata, nil
+}
+
+// verifyFlashedBuild reads back what is on a device in fastboot mode and
+// compares it with the factory image metadata, so that a device is never
+// locked with a build other than the one that was meant to be flashed.
+func verifyFlashedBuild(serialNumber string, metadata *factoryMetadata) error {
+	var problems []string
+	if metadata.Bootloader != "" {
+		if actual := getVar("version-bootloader", serialNumber); !matchesAny(actual, metadata.Bootloader) {
+			problems = append(problems, fmt.Sprintf("bootloader version is %q, expected %q", actual, metadata.Bootloader))
+		}
+	}
+	if metadata.Baseband != "" {
+		if actual := getVar("version-baseband", serialNumber); !matchesAny(actual, metadata.Baseband) {
+			problems = append(problems, fmt.Sprintf("baseband version is %q, expected %q", actual, metadata.Baseband))
+		}
+	}
+	// Only A/B devices have slots
+	if slotCount := getVar("slot-count", serialNumber); slotCount != "" && slotCount != "0" && slotCount != "1" {
+		slot := getVar("current-slot", serialNumber)
+		if slot == "" {
+			problems = append(problems, "current slot cannot be read")
+		} else if getVar("slot-unbootable:"+slot, serialNumber) == "yes" {
+			problems = append(problems, "current slot "+slot+" is marked unbootable")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// verifyFingerprint checks the build a device booted into through adb, which
+// is only possible once the device is up with USB debugging enabled.
+func verifyFingerprint(serialNumber string, metadata *factoryMetadata) error {
+	fingerprint := getProp("ro.build.fingerprint", serialNumber)
+	if fingerprint == "" {
+		return errors.New("build fingerprint cannot be read")
+	}
+	// e.g. google/walleye/walleye:11/RP1A.201005.004/6782484:user/release-keys
+	if metadata.BuildID != "" && !strings.Contains(strings.ToLower(fingerprint), "/"+strings.ToLower(metadata.BuildID)+"/") {
+		return fmt.Errorf("build fingerprint is %q, expected build %s", fingerprint, metadata.BuildID)
+	}
+	return nil
+}
+
+// matchesAny reports whether actual is one of the |-separated alternatives
+// that android-info.txt allows
+func matchesAny(actual, expected string) bool {
+	for _, alternative := range strings.Split(expected, "|") {
+		if strings.EqualFold(actual, alternative) {
+			return true
+		}
+	}
+	return false
+}